@@ -0,0 +1,151 @@
+package genericsite
+
+// Admin panel for managing users
+
+import (
+	"bytes"
+	"html"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/xyproto/pinterface"
+	"github.com/xyproto/webhandle"
+)
+
+// Serves the admin panel, for administrators only
+type AdminEngine struct {
+	state pinterface.IUserState
+}
+
+// Create a new engine for the admin panel
+func NewAdminEngine(userState pinterface.IUserState) *AdminEngine {
+	return &AdminEngine{userState}
+}
+
+// Serve the admin panel at /admin, wrapped in the given base content page
+func ServeAdmin(r *mux.Router, basecp BaseCP, userState pinterface.IUserState, tvgf TemplateValueGeneratorFactory) *AdminEngine {
+	ae := NewAdminEngine(userState)
+	ae.ServePages(r, basecp, tvgf)
+	return ae
+}
+
+// Register the admin pages with the router
+func (ae *AdminEngine) ServePages(r *mux.Router, basecp BaseCP, tvgf TemplateValueGeneratorFactory) {
+	cp := basecp(ae.state)
+	cp.ContentTitle = "Admin"
+	cp.Url = "/admin"
+	r.HandleFunc("/admin", cp.WrapSimpleContextHandle(r, ae.overview, tvgf(ae.state)))
+}
+
+// All usernames, including the unconfirmed ones, sorted
+func (ae *AdminEngine) usernames() ([]string, error) {
+	usernames, err := ae.state.AllUsernames()
+	if err != nil {
+		return nil, err
+	}
+	unconfirmed, err := ae.state.AllUnconfirmedUsernames()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var all []string
+	for _, username := range append(usernames, unconfirmed...) {
+		if !seen[username] {
+			seen[username] = true
+			all = append(all, username)
+		}
+	}
+	sort.Strings(all)
+	return all, nil
+}
+
+// Perform an action on a user. Administrators can not remove or demote themselves.
+func (ae *AdminEngine) perform(action, username, currentUser string) string {
+	if !ae.state.HasUser(username) {
+		return "No such user: " + html.EscapeString(username) + "."
+	}
+	if username == currentUser && (action == "remove" || action == "demote") {
+		return "You can not " + action + " yourself."
+	}
+	switch action {
+	case "confirm":
+		ae.state.Confirm(username)
+		return html.EscapeString(username) + " has been confirmed."
+	case "remove":
+		ae.state.RemoveUnconfirmed(username)
+		ae.state.RemoveUser(username)
+		return html.EscapeString(username) + " has been removed."
+	case "promote":
+		ae.state.SetAdminStatus(username)
+		return html.EscapeString(username) + " is now an administrator."
+	case "demote":
+		ae.state.RemoveAdminStatus(username)
+		return html.EscapeString(username) + " is no longer an administrator."
+	}
+	return "Unknown action: " + html.EscapeString(action) + "."
+}
+
+// A button that posts the given action for the given username to /admin.
+// csrfField is the hidden field with the token of the administrator.
+func actionButton(action, username, buttonText, csrfField string) string {
+	return "<form method=\"POST\" action=\"/admin\" style=\"display: inline;\">" + csrfField + "<input type=\"hidden\" name=\"action\" value=\"" + action + "\"><input type=\"hidden\" name=\"username\" value=\"" + html.EscapeString(username) + "\"><button type=\"submit\">" + buttonText + "</button></form>"
+}
+
+// Table of all users, with buttons for managing them
+func (ae *AdminEngine) userTable(usernames []string, csrfField string) string {
+	var buf bytes.Buffer
+	buf.WriteString("<table class=\"users\"><tr><th>Username</th><th>Email</th><th>Confirmed</th><th>Admin</th><th>Logged in</th><th></th></tr>")
+	for _, username := range usernames {
+		email, _ := ae.state.Email(username)
+		confirmed := ae.state.IsConfirmed(username)
+		admin := ae.state.IsAdmin(username)
+		buf.WriteString("<tr><td>" + html.EscapeString(username) + "</td><td>" + html.EscapeString(email) + "</td>")
+		buf.WriteString(webhandle.TableCell(confirmed))
+		buf.WriteString(webhandle.TableCell(admin))
+		buf.WriteString(webhandle.TableCell(ae.state.IsLoggedIn(username)))
+		buf.WriteString("<td>")
+		if !confirmed {
+			buf.WriteString(actionButton("confirm", username, "Confirm", csrfField))
+		}
+		if admin {
+			buf.WriteString(actionButton("demote", username, "Demote", csrfField))
+		} else {
+			buf.WriteString(actionButton("promote", username, "Promote", csrfField))
+		}
+		buf.WriteString(actionButton("remove", username, "Remove", csrfField))
+		buf.WriteString("</td></tr>")
+	}
+	buf.WriteString("</table>")
+	return buf.String()
+}
+
+// List all users, and perform the posted action, if any
+func (ae *AdminEngine) overview(w http.ResponseWriter, req *http.Request) string {
+	if !ae.state.AdminRights(req) {
+		w.WriteHeader(http.StatusForbidden)
+		return "Permission denied."
+	}
+	msg := ""
+	if req.Method == "POST" {
+		if ValidCSRF(ae.state, req) {
+			action := UserInput(webhandle.GetFormParam(req, "action"))
+			username := UserInput(webhandle.GetFormParam(req, "username"))
+			msg = ae.perform(string(action), string(username), ae.state.Username(req))
+		} else {
+			w.WriteHeader(http.StatusForbidden)
+			msg = csrfMessage
+		}
+	}
+	usernames, err := ae.usernames()
+	if err != nil {
+		return "Could not list the users: " + html.EscapeString(err.Error())
+	}
+	s := ""
+	if msg != "" {
+		s += "<div class=\"message\">" + msg + "</div>"
+	}
+	s += "<h3>Users (" + strconv.Itoa(len(usernames)) + ")</h3>" + ae.userTable(usernames, CSRFField(ae.state, req))
+	return s
+}
@@ -0,0 +1,79 @@
+package genericsite
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Add the form token of the given user to the form values
+func withCSRF(state *memUserState, username string, form url.Values) url.Values {
+	token, _ := csrfToken(state, username)
+	form.Set(csrfTokenField, token)
+	return form
+}
+
+func TestAdminPanel(t *testing.T) {
+	state := newMemUserState()
+	r := mux.NewRouter()
+	ServeAdmin(r, testBaseCP, state, testTVGF())
+
+	state.AddUser("root", "rootpassword", "root@example.com")
+	state.MarkConfirmed("root")
+	state.SetAdminStatus("root")
+	state.SetLoggedIn("root")
+	state.AddUser("frank", "frankpassword", "frank@example.com")
+	state.AddUnconfirmed("frank", "xyz")
+	admin := &http.Cookie{Name: "user", Value: "root"}
+
+	if w := do(r, "GET", "/admin", nil); w.Code != http.StatusForbidden {
+		t.Error("the admin panel should only be available for administrators")
+	}
+	state.SetLoggedIn("frank")
+	if w := do(r, "POST", "/admin", withCSRF(state, "frank", url.Values{"action": {"promote"}, "username": {"frank"}}), &http.Cookie{Name: "user", Value: "frank"}); w.Code != http.StatusForbidden || state.IsAdmin("frank") {
+		t.Error("a regular user could promote themselves")
+	}
+
+	w := do(r, "GET", "/admin", nil, admin)
+	if !strings.Contains(w.Body.String(), "frank@example.com") {
+		t.Fatal("expected the admin panel to list frank")
+	}
+	token, _ := csrfToken(state, "root")
+	if !strings.Contains(w.Body.String(), "name=\"csrftoken\" value=\""+token+"\"") {
+		t.Error("expected the token of the administrator in the forms")
+	}
+
+	// Forms that are posted from other sites do not have the token
+	for _, form := range []url.Values{
+		{"action": {"promote"}, "username": {"frank"}},
+		{"action": {"promote"}, "username": {"frank"}, "csrftoken": {"wrong"}},
+	} {
+		if w := do(r, "POST", "/admin", form, admin); w.Code != http.StatusForbidden || state.IsAdmin("frank") {
+			t.Error("expected the form to be refused without the right token")
+		}
+	}
+
+	do(r, "POST", "/admin", withCSRF(state, "root", url.Values{"action": {"confirm"}, "username": {"frank"}}), admin)
+	if !state.IsConfirmed("frank") {
+		t.Error("frank should be confirmed")
+	}
+	do(r, "POST", "/admin", withCSRF(state, "root", url.Values{"action": {"promote"}, "username": {"frank"}}), admin)
+	if !state.IsAdmin("frank") {
+		t.Error("frank should be an administrator")
+	}
+	do(r, "POST", "/admin", withCSRF(state, "root", url.Values{"action": {"demote"}, "username": {"frank"}}), admin)
+	if state.IsAdmin("frank") {
+		t.Error("frank should no longer be an administrator")
+	}
+	do(r, "POST", "/admin", withCSRF(state, "root", url.Values{"action": {"demote"}, "username": {"root"}}), admin)
+	if !state.IsAdmin("root") {
+		t.Error("administrators should not be able to demote themselves")
+	}
+	do(r, "POST", "/admin", withCSRF(state, "root", url.Values{"action": {"remove"}, "username": {"frank"}}), admin)
+	if state.HasUser("frank") {
+		t.Error("frank should be removed")
+	}
+}
@@ -0,0 +1,230 @@
+package genericsite
+
+// Static assets, served at fingerprinted URLs that can be cached forever
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/xyproto/onthefly"
+	"github.com/xyproto/pinterface"
+)
+
+const (
+	defaultAssetPrefix = "/assets"
+
+	// Fingerprinted URLs never change contents, so they can be cached for a year
+	farFutureCacheControl = "public, max-age=31536000, immutable"
+
+	// Characters of the content hash that are used in the URL
+	fingerprintLength = 12
+)
+
+type (
+	// A static file, like a script, a stylesheet or an image
+	Asset struct {
+		Path        string // the path the asset was registered with, like "/js/jquery.min.js"
+		Hash        string // hex encoded SHA-256 of the contents
+		Integrity   string // for the integrity attribute, see https://www.w3.org/TR/SRI/
+		ContentType string
+		prefix      string
+		variants    *variants
+	}
+
+	// Registered assets, served at fingerprinted URLs
+	Assets struct {
+		Prefix string // the fingerprinted URLs start with this
+		mut    sync.RWMutex
+		byPath map[string]*Asset
+		byURL  map[string]*Asset
+	}
+)
+
+// Create an empty collection of assets, served below /assets
+func NewAssets() *Assets {
+	return &Assets{Prefix: defaultAssetPrefix, byPath: make(map[string]*Asset), byURL: make(map[string]*Asset)}
+}
+
+// The Subresource Integrity hash of the given data, like "sha384-..."
+func Integrity(data []byte) string {
+	sum := sha512.Sum384(data)
+	return "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// The fingerprinted URL, with a part of the hash before the extension, like /assets/js/jquery.min.0123456789ab.js
+func (asset *Asset) URL() string {
+	ext := path.Ext(asset.Path)
+	return asset.prefix + strings.TrimSuffix(asset.Path, ext) + "." + asset.Hash[:fingerprintLength] + ext
+}
+
+// Create an asset, compressed with gzip in advance
+func (a *Assets) newAsset(urlPath string, data []byte) *Asset {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	contentType := mime.TypeByExtension(path.Ext(urlPath))
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	return &Asset{
+		Path:        urlPath,
+		Hash:        hash,
+		Integrity:   Integrity(data),
+		ContentType: contentType,
+		prefix:      a.Prefix,
+		variants:    precompressed(data, "\""+hash+"\""),
+	}
+}
+
+// Register an asset with the given contents
+func (a *Assets) AddData(urlPath string, data []byte) *Asset {
+	asset := a.newAsset(urlPath, data)
+	a.add(asset)
+	return asset
+}
+
+func (a *Assets) add(asset *Asset) {
+	urlPath := asset.Path
+	a.mut.Lock()
+	if old, ok := a.byPath[urlPath]; ok {
+		delete(a.byURL, old.URL())
+	}
+	a.byPath[urlPath] = asset
+	a.byURL[asset.URL()] = asset
+	a.mut.Unlock()
+}
+
+// Register a file as an asset with the given path, like "/js/jquery.min.js".
+// Precompressed files next to it, with .br or .gz added to the filename, are served to clients that accept them.
+func (a *Assets) AddFile(urlPath, filename string) (*Asset, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	asset := a.newAsset(urlPath, data)
+	asset.variants.loadCompressedFiles(filename)
+	a.add(asset)
+	return asset, nil
+}
+
+// Register all files in a directory, and below, with paths starting with the given prefix.
+// For example, AddDir("/img", "static/img") registers static/img/logo.png as /img/logo.png.
+func (a *Assets) AddDir(urlPrefix, dir string) error {
+	return filepath.Walk(dir, func(filename string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		// Precompressed files are added together with the uncompressed file
+		if ext := filepath.Ext(filename); ext == ".br" || ext == ".gz" {
+			if _, err := os.Stat(strings.TrimSuffix(filename, ext)); err == nil {
+				return nil
+			}
+		}
+		rel, err := filepath.Rel(dir, filename)
+		if err != nil {
+			return err
+		}
+		_, err = a.AddFile(path.Join(urlPrefix, filepath.ToSlash(rel)), filename)
+		return err
+	})
+}
+
+// Find a registered asset by the path it was registered with
+func (a *Assets) Get(urlPath string) (*Asset, bool) {
+	a.mut.RLock()
+	defer a.mut.RUnlock()
+	asset, ok := a.byPath[urlPath]
+	return asset, ok
+}
+
+// The fingerprinted URL for the given path, or the path itself if no asset is registered with it
+func (a *Assets) URL(urlPath string) string {
+	if asset, ok := a.Get(urlPath); ok {
+		return asset.URL()
+	}
+	return urlPath
+}
+
+// Serve all registered assets at their fingerprinted URLs, with far-future caching
+func (a *Assets) ServePages(r *mux.Router) {
+	r.PathPrefix(a.Prefix + "/").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		a.mut.RLock()
+		asset, ok := a.byURL[req.URL.Path]
+		a.mut.RUnlock()
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		asset.serve(w, req, farFutureCacheControl)
+	})
+}
+
+func (asset *Asset) serve(w http.ResponseWriter, req *http.Request, cacheControl string) {
+	serveVariants(w, req, asset.variants, asset.ContentType, cacheControl, time.Time{})
+}
+
+// Serve the asset at the path it was registered with, for pages that link to it directly.
+// It is cached for a shorter time, since the contents may change when the server restarts.
+func (asset *Asset) ServeOriginal(r *mux.Router) {
+	r.HandleFunc(asset.Path, func(w http.ResponseWriter, req *http.Request) {
+		asset.serve(w, req, shortCacheControl)
+	})
+}
+
+// Use this asset if jQuery can not be loaded from the CDN the content page points to.
+// cdnIntegrity is the Subresource Integrity hash of the file on the CDN, as published by the CDN.
+// The hash of this asset can not be used, since the CDN usually has a different build of the same version.
+// If cdnIntegrity is empty, the JqueryIntegrity of the content page is kept.
+func (asset *Asset) UseAsJqueryFallback(cp *ContentPage, cdnIntegrity string) {
+	if cp.JqueryJSurl == asset.Path {
+		// Not from a CDN, just use the fingerprinted URL
+		cp.JqueryJSurl = asset.URL()
+		return
+	}
+	if cdnIntegrity != "" {
+		cp.JqueryIntegrity = cdnIntegrity
+	}
+	cp.JqueryFallbackURL = asset.URL()
+}
+
+// Make content pages that use this asset if jQuery can not be loaded from the CDN, see UseAsJqueryFallback
+func (asset *Asset) JqueryFallbackCP(basecp BaseCP, cdnIntegrity string) BaseCP {
+	return func(state pinterface.IUserState) *ContentPage {
+		cp := basecp(state)
+		asset.UseAsJqueryFallback(cp, cdnIntegrity)
+		return cp
+	}
+}
+
+// Link to a script on a CDN, and load a local copy instead if the given JavaScript expression is false
+// after loading, for example "window.jQuery". The integrity and fallback are left out if empty.
+func AddScriptWithFallback(page *onthefly.Page, scriptURL, integrity, fallbackURL, test string) error {
+	script, err := page.LinkToJSInHead(scriptURL)
+	if err != nil {
+		return err
+	}
+	if integrity != "" {
+		script.AddAttrib("integrity", integrity)
+		script.AddAttrib("crossorigin", "anonymous")
+	}
+	if fallbackURL == "" {
+		return nil
+	}
+	if test == "" {
+		return errors.New("a test is needed for loading the fallback script")
+	}
+	_, err = page.AddScriptToHead(test + " || document.write('<script src=\"" + fallbackURL + "\"><\\/script>');")
+	return err
+}
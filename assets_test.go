@@ -0,0 +1,86 @@
+package genericsite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAssets(t *testing.T) {
+	assets := NewAssets()
+	asset := assets.AddData("/js/app.js", []byte("alert('hi');"))
+	if !strings.HasPrefix(asset.URL(), "/assets/js/app.") || !strings.HasSuffix(asset.URL(), ".js") {
+		t.Error("unexpected fingerprinted URL: " + asset.URL())
+	}
+	if asset.Integrity != "sha384-FANl2IiScBgbQg1ZiXDX2/KBIClVPK/2G9OPEEydFX4pOsLyf8a9qfpBudHpQY1u" {
+		t.Error("unexpected integrity hash: " + asset.Integrity)
+	}
+	if assets.URL("/js/unknown.js") != "/js/unknown.js" {
+		t.Error("unknown assets should keep their path")
+	}
+	r := mux.NewRouter()
+	assets.ServePages(r)
+
+	rec := do(r, "GET", asset.URL(), nil)
+	if rec.Body.String() != "alert('hi');" || !strings.Contains(rec.Header().Get("Cache-Control"), "max-age=31536000") {
+		t.Error("expected the asset with far-future caching")
+	}
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/javascript") && !strings.HasPrefix(rec.Header().Get("Content-Type"), "application/javascript") {
+		t.Error("wrong content type: " + rec.Header().Get("Content-Type"))
+	}
+
+	// A new version gets a new URL, and the old URL is gone
+	newer := assets.AddData("/js/app.js", []byte("alert('hello');"))
+	if newer.URL() == asset.URL() || do(r, "GET", asset.URL(), nil).Code != 404 || do(r, "GET", newer.URL(), nil).Code != 200 {
+		t.Error("expected only the new version to be served")
+	}
+}
+
+func TestAssetsDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "icons"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "icons", "logo.svg"), []byte("<svg></svg>"), 0644)
+
+	assets := NewAssets()
+	if err := assets.AddDir("/img", dir); err != nil {
+		t.Fatal(err)
+	}
+	if asset, ok := assets.Get("/img/icons/logo.svg"); !ok || asset.ContentType != "image/svg+xml" {
+		t.Error("expected the image to be registered")
+	}
+}
+
+func TestJqueryFallback(t *testing.T) {
+	asset := NewAssets().AddData("/js/jquery.js", []byte("window.jQuery = {};"))
+	cp := DefaultCP(nil)
+	asset.UseAsJqueryFallback(cp, "")
+	html := genericPageBuilder(cp).String()
+	if strings.Contains(html, "integrity=") {
+		t.Error("the hash of the local copy should not be used for the CDN")
+	}
+	cdnIntegrity := "sha384-fromthecdn"
+	asset.UseAsJqueryFallback(cp, cdnIntegrity)
+	html = genericPageBuilder(cp).String()
+	if !strings.Contains(html, "integrity=\""+cdnIntegrity+"\"") || !strings.Contains(html, "crossorigin=\"anonymous\"") {
+		t.Error("expected the integrity hash for the CDN")
+	}
+	if !strings.Contains(html, "window.jQuery || document.write('<script src=\""+asset.URL()+"\"><\\/script>');") {
+		t.Error("expected a fallback to the local copy")
+	}
+
+	// Pages that use the local copy directly get the fingerprinted URL
+	cp = DefaultCP(nil)
+	cp.JqueryJSurl = "/js/jquery.js"
+	asset.UseAsJqueryFallback(cp, cdnIntegrity)
+	if cp.JqueryJSurl != asset.URL() || cp.JqueryFallbackURL != "" {
+		t.Error("expected the fingerprinted URL")
+	}
+}
@@ -0,0 +1,304 @@
+package genericsite
+
+// Login, registration, logout and confirmation pages
+
+import (
+	"errors"
+	"html"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/xyproto/onthefly"
+	"github.com/xyproto/permissions2"
+	"github.com/xyproto/pinterface"
+	"github.com/xyproto/webhandle"
+)
+
+const minimumPasswordLength = 6
+
+var (
+	// The configured URL of the site, like "https://example.com", or empty for using the Host header
+	siteURL    string
+	siteURLMut sync.RWMutex
+)
+
+// Serves the pages for logging in, registering, logging out and confirming users
+type UserEngine struct {
+	state        pinterface.IUserState
+	resetTimeout time.Duration
+	email        *EmailSettings
+	background   sync.WaitGroup // email that is sent in the background
+}
+
+// Create a new engine for logging in and registering users
+func NewUserEngine(userState pinterface.IUserState) *UserEngine {
+	return &UserEngine{state: userState, resetTimeout: defaultResetTimeout}
+}
+
+// Serve /login, /register, /logout, /confirm/{code}, /forgot-password, /reset/{token} and /forgot-username, wrapped in the given base content page
+// Call SetSiteURL first, so that the links in the emails do not depend on the Host header.
+func ServeAuth(r *mux.Router, basecp BaseCP, userState pinterface.IUserState, tvgf TemplateValueGeneratorFactory) *UserEngine {
+	ue := NewUserEngine(userState)
+	ue.ServePages(r, basecp, tvgf)
+	return ue
+}
+
+// Set the templates and style for the emails that are sent.
+// By default, the emails are styled after the base content page.
+func (ue *UserEngine) SetEmailSettings(es *EmailSettings) {
+	ue.email = es
+}
+
+// Register the user pages with the router
+func (ue *UserEngine) ServePages(r *mux.Router, basecp BaseCP, tvgf TemplateValueGeneratorFactory) {
+	if ue.email == nil {
+		ue.email = NewEmailSettings(basecp(ue.state))
+	}
+	tvg := tvgf(ue.state)
+	ue.servePage(r, basecp, tvg, "/login", "Login", ue.login)
+	ue.servePage(r, basecp, tvg, "/register", "Register", ue.register)
+	ue.servePage(r, basecp, tvg, "/logout", "Logout", ue.logout)
+	ue.servePage(r, basecp, tvg, "/confirm/{code}", "Confirmation", ue.confirm)
+	ue.serveRecoveryPages(r, basecp, tvg)
+}
+
+// Wrap a page generating function in a content page, with the given title
+func (ue *UserEngine) servePage(r *mux.Router, basecp BaseCP, tvg webhandle.TemplateValueGenerator, url, title string, sch func(http.ResponseWriter, *http.Request) string) {
+	cp := basecp(ue.state)
+	cp.ContentTitle = title
+	cp.Url = url
+	r.HandleFunc(url, cp.WrapSimpleContextHandle(r, sch, tvg))
+}
+
+// Show the login form, or log in the user
+func (ue *UserEngine) login(w http.ResponseWriter, req *http.Request) string {
+	csrfField := LoginCSRFField(w, req)
+	if req.Method != "POST" {
+		return LoginForm(csrfField)
+	}
+	// Other sites must not be able to log someone in as another user
+	if !ValidLoginCSRF(req) {
+		w.WriteHeader(http.StatusForbidden)
+		return MessageAndForm(csrfMessage, LoginForm(csrfField))
+	}
+	username := UserInput(webhandle.GetFormParam(req, "username"))
+	password := UserInput(webhandle.GetFormParam(req, "password"))
+	if username == "" || password == "" {
+		return MessageAndForm("Please fill in both the username and the password.", LoginForm(csrfField))
+	}
+	// Use the same message for unknown users and wrong passwords
+	if !ue.state.HasUser(string(username)) || !ue.state.CorrectPassword(string(username), string(password)) {
+		return MessageAndForm("Wrong username or password.", LoginForm(csrfField))
+	}
+	if !ue.state.IsConfirmed(string(username)) {
+		return "The registration for " + username.HTML() + " has not been confirmed yet. Please check your email for a confirmation link."
+	}
+	// A new session gets a new token for the forms
+	removeCSRFToken(ue.state, string(username))
+	if err := ue.state.Login(w, string(username)); err != nil {
+		return "Could not log in: " + html.EscapeString(err.Error())
+	}
+	removeLoginCSRFCookie(w)
+	return "Welcome back, " + username.HTML() + "!" + onthefly.JS(onthefly.Redirect("/"))
+}
+
+// Show the registration form, or register a new user and send a confirmation email
+func (ue *UserEngine) register(w http.ResponseWriter, req *http.Request) string {
+	if req.Method != "POST" {
+		return RegisterForm()
+	}
+	username := UserInput(webhandle.GetFormParam(req, "username"))
+	password1 := UserInput(webhandle.GetFormParam(req, "password1"))
+	password2 := UserInput(webhandle.GetFormParam(req, "password2"))
+	email := UserInput(webhandle.GetFormParam(req, "email"))
+
+	if username == "" || password1 == "" || email == "" {
+		return MessageAndForm("Please fill in the username, password and email.", RegisterForm())
+	}
+	if err := permissions.ValidUsernamePassword(string(username), string(password1)); err != nil {
+		return MessageAndForm("Invalid username or password: "+html.EscapeString(err.Error())+".", RegisterForm())
+	}
+	if len(password1) < minimumPasswordLength {
+		return MessageAndForm("The password is too short.", RegisterForm())
+	}
+	if password1 != password2 {
+		return MessageAndForm("The passwords do not match.", RegisterForm())
+	}
+	if _, err := mail.ParseAddress(string(email)); err != nil {
+		return MessageAndForm("Invalid email address.", RegisterForm())
+	}
+	if ue.state.HasUser(string(username)) {
+		return MessageAndForm("The username "+username.HTML()+" is already taken.", RegisterForm())
+	}
+	if len(UsernamesByEmail(ue.state, string(email))) > 0 {
+		return MessageAndForm("That email address is already registered.", RegisterForm())
+	}
+
+	confirmationCode, err := ue.state.GenerateUniqueConfirmationCode()
+	if err != nil {
+		return "Could not generate a confirmation code: " + html.EscapeString(err.Error())
+	}
+
+	ue.state.AddUser(string(username), string(password1), string(email))
+	ue.state.AddUnconfirmed(string(username), confirmationCode)
+
+	link := BaseURL(req) + "/confirm/" + confirmationCode
+	if err := ue.email.ConfirmationEmail(Domain(req), link, string(username), string(email)); err != nil {
+		// Let the user try again
+		ue.state.RemoveUnconfirmed(string(username))
+		ue.state.RemoveUser(string(username))
+		return "Could not send the confirmation email. Please try again later."
+	}
+
+	return "Thank you for registering, " + username.HTML() + ". A confirmation link has been sent to " + email.HTML() + "."
+}
+
+// Show a button for logging out, or log out the current user.
+// Logging out must be posted with the form token, so that other sites can not log users out.
+func (ue *UserEngine) logout(w http.ResponseWriter, req *http.Request) string {
+	username := ue.state.Username(req)
+	if username == "" {
+		return "You are not logged in."
+	}
+	csrfField := CSRFField(ue.state, req)
+	if req.Method != "POST" {
+		return "You are logged in as " + html.EscapeString(username) + "." + LogoutForm(csrfField)
+	}
+	if !ValidCSRF(ue.state, req) {
+		w.WriteHeader(http.StatusForbidden)
+		return MessageAndForm(csrfMessage, LogoutForm(csrfField))
+	}
+	ue.state.Logout(username)
+	removeCSRFToken(ue.state, username)
+	ue.state.ClearCookie(w)
+	return "Goodbye, " + html.EscapeString(username) + "." + onthefly.JS(onthefly.Redirect("/"))
+}
+
+// Confirm a registered user by the code that was sent by email
+func (ue *UserEngine) confirm(w http.ResponseWriter, req *http.Request) string {
+	confirmationCode := UserInput(mux.Vars(req)["code"])
+	if err := ue.state.ConfirmUserByConfirmationCode(string(confirmationCode)); err != nil {
+		return "Could not confirm the registration: " + html.EscapeString(err.Error()) + "."
+	}
+	return "Thank you, your registration is confirmed. You may now <a href=\"/login\">log in</a>."
+}
+
+// Escape the user input so that it can be safely displayed in a page
+func (ui UserInput) HTML() string {
+	return html.EscapeString(string(ui))
+}
+
+// Find all usernames that have the given email address
+func UsernamesByEmail(state pinterface.IUserState, email string) []string {
+	var found []string
+	usernames, err := state.AllUsernames()
+	if err != nil {
+		return found
+	}
+	for _, username := range usernames {
+		userEmail, err := state.Email(username)
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(userEmail, email) {
+			found = append(found, username)
+		}
+	}
+	return found
+}
+
+// Set the URL of the site, like "https://example.com". It is used for the links in emails,
+// the sitemap, robots.txt and the feeds, instead of the Host header, which is chosen by the client.
+// An empty string removes the setting.
+func SetSiteURL(s string) error {
+	if s != "" {
+		u, err := url.Parse(s)
+		if err != nil {
+			return err
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+			return errors.New("the site URL must be a scheme and a host, like https://example.com: " + s)
+		}
+		s = u.Scheme + "://" + u.Host
+	}
+	siteURLMut.Lock()
+	siteURL = s
+	siteURLMut.Unlock()
+	return nil
+}
+
+// The URL of the site, as set with SetSiteURL, or an empty string
+func SiteURL() string {
+	siteURLMut.RLock()
+	defer siteURLMut.RUnlock()
+	return siteURL
+}
+
+// The scheme and host of the site, like "https://example.com".
+// The request is only used if no site URL has been set with SetSiteURL.
+func BaseURL(req *http.Request) string {
+	if s := SiteURL(); s != "" {
+		return s
+	}
+	if req.TLS != nil {
+		return "https://" + req.Host
+	}
+	return "http://" + req.Host
+}
+
+// The host of the site, without the port.
+// The request is only used if no site URL has been set with SetSiteURL.
+func Domain(req *http.Request) string {
+	host := req.Host
+	if s := SiteURL(); s != "" {
+		host = strings.SplitN(s, "://", 2)[1]
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// A message followed by a form
+func MessageAndForm(msg, form string) string {
+	return "<div class=\"message\">" + msg + "</div>" + form
+}
+
+// A labeled input field for a form
+func formField(label, name, inputType string) string {
+	return "<div class=\"formfield\"><label for=\"" + name + "\" style=\"display: inline-block; width: 10em;\">" + label + "</label><input id=\"" + name + "\" name=\"" + name + "\" type=\"" + inputType + "\"></div>"
+}
+
+// A form that posts the given fields to the given url
+func form(id, action, buttonText string, fields ...string) string {
+	return "<form id=\"" + id + "\" action=\"" + action + "\" method=\"POST\">" + strings.Join(fields, "") + "<div class=\"formfield\"><button type=\"submit\">" + buttonText + "</button></div></form>"
+}
+
+// Login form, posts "username" and "password" to /login, with the field from LoginCSRFField
+func LoginForm(csrfField string) string {
+	return form("loginForm", "/login", "Login",
+		csrfField,
+		formField("Username:", "username", "text"),
+		formField("Password:", "password", "password")) +
+		"<div class=\"formlinks\"><a href=\"/forgot-password\">Forgot password?</a> <a href=\"/forgot-username\">Forgot username?</a></div>"
+}
+
+// Logout form, posts the field from CSRFField to /logout
+func LogoutForm(csrfField string) string {
+	return form("logoutForm", "/logout", "Log out", csrfField)
+}
+
+// Registration form, posts "username", "password1", "password2" and "email" to /register
+func RegisterForm() string {
+	return form("registerForm", "/register", "Register",
+		formField("Username:", "username", "text"),
+		formField("Password:", "password1", "password"),
+		formField("Confirm password:", "password2", "password"),
+		formField("Email:", "email", "email"))
+}
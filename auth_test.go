@@ -0,0 +1,343 @@
+package genericsite
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/xyproto/pinterface"
+)
+
+func testBaseCP(state pinterface.IUserState) *ContentPage {
+	cp := DefaultCP(state)
+	cp.Title = "Test Site"
+	cp.Subtitle = "testing"
+	return cp
+}
+
+func testTVGF() TemplateValueGeneratorFactory {
+	return DynamicMenuFactoryGenerator(Links2menuEntries([]string{"Overview:/", "Login:/login", "Register:/register", "Logout:/logout"}))
+}
+
+// Send a request to the router and return the response
+func do(r *mux.Router, method, target string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	var req *http.Request
+	if form != nil {
+		req = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req = httptest.NewRequest(method, target, nil)
+	}
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// Get the login form, and return the cookie with the token, and the form values with the same token
+func withLoginCSRF(r *mux.Router, form url.Values) (url.Values, *http.Cookie) {
+	for _, c := range do(r, "GET", "/login", nil).Result().Cookies() {
+		if c.Name == loginTokenCookie {
+			form.Set(csrfTokenField, c.Value)
+			return form, c
+		}
+	}
+	return form, nil
+}
+
+func TestLoginConfirmLogout(t *testing.T) {
+	state := newMemUserState()
+	r := mux.NewRouter()
+	ServeAuth(r, testBaseCP, state, testTVGF())
+
+	state.AddUser("bob", "hunter22", "bob@example.com")
+	state.AddUnconfirmed("bob", "abc")
+
+	w := do(r, "GET", "/login", nil)
+	if !strings.Contains(w.Body.String(), "loginForm") || !strings.Contains(w.Body.String(), "Test") {
+		t.Fatal("expected a login form wrapped in the site layout")
+	}
+
+	w = do(r, "POST", "/login", url.Values{"username": {"bob"}, "password": {"hunter22"}})
+	if w.Code != http.StatusForbidden || state.IsLoggedIn("bob") {
+		t.Error("the login form should not be accepted without the token")
+	}
+	form, cookie := withLoginCSRF(r, url.Values{"username": {"bob"}, "password": {"hunter22"}})
+	if cookie == nil || !strings.Contains(do(r, "GET", "/login", nil, cookie).Body.String(), "value=\""+cookie.Value+"\"") {
+		t.Fatal("expected the token of the cookie in the login form")
+	}
+	if w = do(r, "POST", "/login", url.Values{"username": {"bob"}, "password": {"hunter22"}, csrfTokenField: {"wrong"}}, cookie); w.Code != http.StatusForbidden {
+		t.Error("the login form should not be accepted with the wrong token")
+	}
+
+	w = do(r, "POST", "/login", form, cookie)
+	if !strings.Contains(w.Body.String(), "not been confirmed") {
+		t.Error("unconfirmed users should not be able to log in")
+	}
+
+	w = do(r, "GET", "/confirm/abc", nil)
+	if !state.IsConfirmed("bob") {
+		t.Fatal("bob should be confirmed: " + w.Body.String())
+	}
+
+	w = do(r, "POST", "/login", url.Values{"username": {"bob"}, "password": {"wrong"}, csrfTokenField: {cookie.Value}}, cookie)
+	if state.IsLoggedIn("bob") || !strings.Contains(w.Body.String(), "Wrong username or password") {
+		t.Error("logged in with the wrong password")
+	}
+
+	w = do(r, "POST", "/login", form, cookie)
+	if !state.IsLoggedIn("bob") {
+		t.Fatal("bob should be logged in")
+	}
+	bob := &http.Cookie{Name: "user", Value: "bob"}
+
+	// Other sites can link to /logout, or post to it, but not with the token
+	if w = do(r, "GET", "/logout", nil, bob); !state.IsLoggedIn("bob") || !strings.Contains(w.Body.String(), "logoutForm") {
+		t.Error("bob should only be logged out by posting the form")
+	}
+	if w = do(r, "POST", "/logout", url.Values{}, bob); w.Code != http.StatusForbidden || !state.IsLoggedIn("bob") {
+		t.Error("bob should not be logged out without the token")
+	}
+	do(r, "POST", "/logout", withCSRF(state, "bob", url.Values{}), bob)
+	if state.IsLoggedIn("bob") {
+		t.Error("bob should be logged out")
+	}
+}
+
+func TestRegisterValidation(t *testing.T) {
+	state := newMemUserState()
+	r := mux.NewRouter()
+	ServeAuth(r, testBaseCP, state, testTVGF())
+
+	w := do(r, "POST", "/register", url.Values{"username": {"alice"}, "password1": {"secret1"}, "password2": {"secret2"}, "email": {"alice@example.com"}})
+	if !strings.Contains(w.Body.String(), "do not match") || state.HasUser("alice") {
+		t.Error("expected the registration to fail when the passwords differ")
+	}
+
+	w = do(r, "POST", "/register", url.Values{"username": {"al ice"}, "password1": {"secret1"}, "password2": {"secret1"}, "email": {"alice@example.com"}})
+	if !strings.Contains(w.Body.String(), "Invalid username") || state.HasUser("al ice") {
+		t.Error("expected the registration to fail for an invalid username")
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	state := newMemUserState()
+	r := mux.NewRouter()
+	ue := ServeAuth(r, testBaseCP, state, testTVGF())
+
+	state.AddUser("carol", "oldpassword", "carol@example.com")
+	token, err := ue.NewResetToken("carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := do(r, "GET", "/reset/"+token, nil)
+	if !strings.Contains(w.Body.String(), "resetPasswordForm") {
+		t.Fatal("expected a form for choosing a new password")
+	}
+
+	form := url.Values{"password1": {"newpassword"}, "password2": {"newpassword"}}
+	do(r, "POST", "/reset/"+token, form)
+	if !state.CorrectPassword("carol", "newpassword") {
+		t.Fatal("the password should have been changed")
+	}
+
+	// The token can only be used once
+	w = do(r, "POST", "/reset/"+token, url.Values{"password1": {"another1"}, "password2": {"another1"}})
+	if state.CorrectPassword("carol", "another1") || !strings.Contains(w.Body.String(), "no longer valid") {
+		t.Error("a reset token was used twice")
+	}
+
+	// Only the newest link is valid
+	old, _ := ue.NewResetToken("carol")
+	token, _ = ue.NewResetToken("carol")
+	if _, ok := ue.FindUserByResetToken(old); ok {
+		t.Error("an old reset token was accepted")
+	}
+	if username, ok := ue.FindUserByResetToken(token); !ok || username != "carol" {
+		t.Error("expected to find carol by the reset token")
+	}
+
+	// Only one of several requests with the same link at the same time can change the password
+	var wg sync.WaitGroup
+	changed := make(chan bool, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			password := "concurrent" + strconv.Itoa(i)
+			w := do(r, "POST", "/reset/"+token, url.Values{"password1": {password}, "password2": {password}})
+			changed <- strings.Contains(w.Body.String(), "has been changed")
+		}(i)
+	}
+	wg.Wait()
+	close(changed)
+	count := 0
+	for ok := range changed {
+		if ok {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("expected the password to be changed once, not %d times", count)
+	}
+
+	// Expired tokens are refused
+	used := token
+	ue.SetResetTimeout(-time.Minute)
+	token, _ = ue.NewResetToken("carol")
+	if _, ok := ue.FindUserByResetToken(token); ok {
+		t.Error("an expired reset token was accepted")
+	}
+
+	// The uses are counted until the token expires, and then removed
+	uses, _ := state.Creator().NewKeyValue(resetUsesID)
+	ue.useResetToken(token)
+	ue.NewResetToken("carol")
+	if _, err := uses.Get(hashToken(token)); err == nil {
+		t.Error("the uses of an expired token should be removed")
+	}
+	if _, err := uses.Get(hashToken(used)); err != nil {
+		t.Error("the uses of a token should be kept until it expires")
+	}
+}
+
+func TestForgotUsernameDoesNotTell(t *testing.T) {
+	mm := NewMemoryMailer()
+	SetMailer(mm)
+	defer SetMailer(NewSMTPMailer("localhost", 25, "", ""))
+
+	state := newMemUserState()
+	r := mux.NewRouter()
+	ue := ServeAuth(r, testBaseCP, state, testTVGF())
+	// The email is sent in the background, and must be sent before the Mailer is changed by another test
+	defer ue.wait()
+
+	state.AddUser("dave", "password1", "dave@example.com")
+
+	known := do(r, "POST", "/forgot-username", url.Values{"email": {"dave@example.com"}}).Body.String()
+	unknown := do(r, "POST", "/forgot-username", url.Values{"email": {"nobody@example.com"}}).Body.String()
+	const reply = "is registered, the username has been sent to it."
+	if !strings.Contains(known, reply) || !strings.Contains(unknown, reply) {
+		t.Error("the response tells if the email address is registered or not")
+	}
+	if strings.Contains(strings.Replace(known, "dave@example.com", "", -1), "dave") {
+		t.Error("the username was shown in the response")
+	}
+	ue.wait()
+	if sent := mm.Sent(); len(sent) != 1 || sent[0].To[0] != "dave@example.com" {
+		t.Errorf("expected one email to dave, got %d", len(sent))
+	}
+}
+
+func TestRegisterSendsConfirmation(t *testing.T) {
+	mm := NewMemoryMailer()
+	SetMailer(mm)
+	defer SetMailer(NewSMTPMailer("localhost", 25, "", ""))
+
+	state := newMemUserState()
+	r := mux.NewRouter()
+	ServeAuth(r, testBaseCP, state, testTVGF())
+
+	do(r, "POST", "/register", url.Values{"username": {"erin"}, "password1": {"secret1"}, "password2": {"secret1"}, "email": {"erin@example.com"}})
+	if !state.HasUser("erin") || state.IsConfirmed("erin") {
+		t.Fatal("expected erin to be registered, but not confirmed")
+	}
+	sent := mm.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("expected one confirmation email, got %d", len(sent))
+	}
+	code, _ := state.ConfirmationCode("erin")
+	if !strings.Contains(string(sent[0].Msg), "/confirm/"+code) {
+		t.Error("the confirmation email does not contain the confirmation link")
+	}
+}
+
+// A Mailer that always fails
+type brokenMailer struct{}
+
+func (brokenMailer) Send(from string, to []string, msg []byte) error {
+	return errors.New("no mail server")
+}
+
+func TestForgotPasswordLogsErrors(t *testing.T) {
+	SetMailer(brokenMailer{})
+	defer SetMailer(NewSMTPMailer("localhost", 25, "", ""))
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	state := newMemUserState()
+	r := mux.NewRouter()
+	ue := ServeAuth(r, testBaseCP, state, testTVGF())
+	state.AddUser("gina", "password1", "gina@example.com")
+
+	do(r, "POST", "/forgot-password", url.Values{"email": {"gina@example.com"}})
+	do(r, "POST", "/forgot-username", url.Values{"email": {"gina@example.com"}})
+	ue.wait()
+	if !strings.Contains(buf.String(), "password reset email for gina: no mail server") || !strings.Contains(buf.String(), "username to gina@example.com: no mail server") {
+		t.Error("expected the errors to be logged: " + buf.String())
+	}
+}
+
+func TestResetLinkUsesSiteURL(t *testing.T) {
+	mm := NewMemoryMailer()
+	SetMailer(mm)
+	defer SetMailer(NewSMTPMailer("localhost", 25, "", ""))
+	if err := SetSiteURL("https://example.com/"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetSiteURL("")
+
+	state := newMemUserState()
+	r := mux.NewRouter()
+	ue := ServeAuth(r, testBaseCP, state, testTVGF())
+	state.AddUser("hank", "password1", "hank@example.com")
+
+	// The Host header is chosen by whoever sends the request
+	do(r, "POST", "http://attacker.example/forgot-password", url.Values{"email": {"hank@example.com"}})
+	ue.wait()
+	sent := mm.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("expected one email, got %d", len(sent))
+	}
+	if msg := string(sent[0].Msg); !strings.Contains(msg, "https://example.com/reset/") || strings.Contains(msg, "attacker.example") {
+		t.Error("expected the reset link to use the site URL:\n" + msg)
+	}
+
+	for _, bad := range []string{"example.com", "ftp://example.com", "https://example.com/path", "https://user@example.com", "https://example.com?x=1"} {
+		if SetSiteURL(bad) == nil {
+			t.Error("expected an invalid site URL: " + bad)
+		}
+	}
+}
+
+func TestConfirmationLinkUsesSiteURL(t *testing.T) {
+	mm := NewMemoryMailer()
+	SetMailer(mm)
+	defer SetMailer(NewSMTPMailer("localhost", 25, "", ""))
+	SetSiteURL("https://example.com")
+	defer SetSiteURL("")
+
+	state := newMemUserState()
+	r := mux.NewRouter()
+	ServeAuth(r, testBaseCP, state, testTVGF())
+
+	do(r, "POST", "http://attacker.example/register", url.Values{"username": {"ivy"}, "password1": {"secret1"}, "password2": {"secret1"}, "email": {"ivy@example.com"}})
+	code, _ := state.ConfirmationCode("ivy")
+	if sent := mm.Sent(); len(sent) != 1 || !strings.Contains(string(sent[0].Msg), "https://example.com/confirm/"+code) || strings.Contains(string(sent[0].Msg), "attacker.example") {
+		t.Error("expected the confirmation link to use the site URL")
+	}
+}
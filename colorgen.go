@@ -0,0 +1,406 @@
+package genericsite
+
+// Procedural generation of color schemes, and checking that the text in them is readable
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	// The minimum contrast ratios of WCAG 2.1 level AA, see https://www.w3.org/TR/WCAG21/#contrast-minimum
+	contrastAA      = 4.5
+	contrastAALarge = 3.0 // for text that is at least 18pt, or 14pt and bold
+
+	// The background of the menu, behind the texture
+	menuBackground = "#0c0c0c"
+)
+
+type (
+	// A color, with each component from 0 to 1
+	rgba struct {
+		r, g, b, a float64
+	}
+
+	// A pair of colors in a theme, where the text may be hard to read
+	ContrastIssue struct {
+		Foreground      string // the name of the text color, like "title_text"
+		Background      string // the name of the background color, like "darkgray"
+		ForegroundColor string
+		BackgroundColor string
+		Ratio           float64
+		Minimum         float64 // the ratio that is needed for WCAG AA
+	}
+
+	// A text color and the background it is shown on
+	colorPair struct {
+		fgName, bgName string
+		fg, bg         string
+		behind         string  // what is behind the background, if it is transparent
+		set            *string // where a more readable text color is stored
+		min            float64
+	}
+)
+
+func (ci ContrastIssue) String() string {
+	return fmt.Sprintf("%s (%s) on %s (%s): %.2f:1, needs %.1f:1", ci.Foreground, ci.ForegroundColor, ci.Background, ci.BackgroundColor, ci.Ratio, ci.Minimum)
+}
+
+// Parse a component of rgb(), either a number from 0 to 255 or a percentage
+func parseRGBComponent(s string) (float64, error) {
+	if strings.HasSuffix(s, "%") {
+		f, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		return f / 100, err
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return f / 255, err
+}
+
+// Parse an alpha value, either a number from 0 to 1 or a percentage
+func parseAlpha(s string) (float64, error) {
+	if strings.HasSuffix(s, "%") {
+		f, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		return f / 100, err
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// Parse a hue, in degrees unless another unit is given
+func parseHue(s string) (float64, error) {
+	unit := 1.0
+	switch {
+	case strings.HasSuffix(s, "deg"):
+		s = strings.TrimSuffix(s, "deg")
+	case strings.HasSuffix(s, "turn"):
+		s, unit = strings.TrimSuffix(s, "turn"), 360
+	case strings.HasSuffix(s, "rad"):
+		s, unit = strings.TrimSuffix(s, "rad"), 180/math.Pi
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return f * unit, err
+}
+
+func clamp(f float64) float64 {
+	return math.Max(0, math.Min(1, f))
+}
+
+// Parse a CSS color, as accepted by ValidCSSColor, except for "currentcolor"
+func parseCSSColor(color string) (rgba, error) {
+	c := strings.ToLower(strings.TrimSpace(color))
+	if !ValidCSSColor(c) || c == "currentcolor" {
+		return rgba{}, errors.New("not a color that can be used here: " + color)
+	}
+	if c == "transparent" {
+		return rgba{0, 0, 0, 0}, nil
+	}
+	if hex, ok := cssColorNames[c]; ok {
+		c = hex
+	}
+	if strings.HasPrefix(c, "#") {
+		digits := c[1:]
+		if len(digits) <= 4 {
+			// Each digit is doubled, #abc is #aabbcc
+			long := ""
+			for _, r := range digits {
+				long += string(r) + string(r)
+			}
+			digits = long
+		}
+		if len(digits) == 6 {
+			digits += "ff"
+		}
+		n, err := strconv.ParseUint(digits, 16, 32)
+		if err != nil {
+			return rgba{}, err
+		}
+		return rgba{float64(n>>24&0xff) / 255, float64(n>>16&0xff) / 255, float64(n>>8&0xff) / 255, float64(n&0xff) / 255}, nil
+	}
+	open := strings.Index(c, "(")
+	fn := c[:open]
+	args := strings.Fields(strings.NewReplacer(",", " ", "/", " ").Replace(c[open+1 : len(c)-1]))
+	var col rgba
+	var err error
+	col.a = 1
+	if len(args) == 4 {
+		if col.a, err = parseAlpha(args[3]); err != nil {
+			return rgba{}, err
+		}
+	}
+	if strings.HasPrefix(fn, "rgb") {
+		for i, dst := range []*float64{&col.r, &col.g, &col.b} {
+			if *dst, err = parseRGBComponent(args[i]); err != nil {
+				return rgba{}, err
+			}
+		}
+	} else {
+		h, err := parseHue(args[0])
+		if err != nil {
+			return rgba{}, err
+		}
+		s, err := parseAlpha(strings.TrimSuffix(args[1], "%") + "%")
+		if err != nil {
+			return rgba{}, err
+		}
+		l, err := parseAlpha(strings.TrimSuffix(args[2], "%") + "%")
+		if err != nil {
+			return rgba{}, err
+		}
+		col.r, col.g, col.b = hslToRGB(h, s, l)
+	}
+	return rgba{clamp(col.r), clamp(col.g), clamp(col.b), clamp(col.a)}, nil
+}
+
+// The color as #rrggbb. The alpha value is not included.
+func (c rgba) hex() string {
+	return fmt.Sprintf("#%02x%02x%02x", int(math.Round(c.r*255)), int(math.Round(c.g*255)), int(math.Round(c.b*255)))
+}
+
+// The color on top of the given opaque color
+func (c rgba) over(behind rgba) rgba {
+	return rgba{
+		c.r*c.a + behind.r*(1-c.a),
+		c.g*c.a + behind.g*(1-c.a),
+		c.b*c.a + behind.b*(1-c.a),
+		1,
+	}
+}
+
+// Convert from RGB to hue (0 to 360), saturation and lightness (0 to 1)
+func rgbToHSL(r, g, b float64) (h, s, l float64) {
+	max := math.Max(r, math.Max(g, b))
+	min := math.Min(r, math.Min(g, b))
+	l = (max + min) / 2
+	if max == min {
+		return 0, 0, l
+	}
+	d := max - min
+	if l > 0.5 {
+		s = d / (2 - max - min)
+	} else {
+		s = d / (max + min)
+	}
+	switch max {
+	case r:
+		h = (g - b) / d
+		if g < b {
+			h += 6
+		}
+	case g:
+		h = (b-r)/d + 2
+	default:
+		h = (r-g)/d + 4
+	}
+	return h * 60, s, l
+}
+
+// Convert from hue (in degrees), saturation and lightness (0 to 1) to RGB
+func hslToRGB(h, s, l float64) (r, g, b float64) {
+	h = math.Mod(h, 360)
+	if h < 0 {
+		h += 360
+	}
+	s, l = clamp(s), clamp(l)
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	return r + m, g + m, b + m
+}
+
+// A color as #rrggbb, from hue, saturation and lightness
+func hsl(h, s, l float64) string {
+	r, g, b := hslToRGB(h, s, l)
+	return rgba{r, g, b, 1}.hex()
+}
+
+// The relative luminance, see https://www.w3.org/TR/WCAG21/#dfn-relative-luminance
+func (c rgba) luminance() float64 {
+	linear := func(v float64) float64 {
+		if v <= 0.03928 {
+			return v / 12.92
+		}
+		return math.Pow((v+0.055)/1.055, 2.4)
+	}
+	return 0.2126*linear(c.r) + 0.7152*linear(c.g) + 0.0722*linear(c.b)
+}
+
+// The contrast ratio between two opaque colors, from 1 to 21
+func contrast(a, b rgba) float64 {
+	la, lb := a.luminance(), b.luminance()
+	if la < lb {
+		la, lb = lb, la
+	}
+	return (la + 0.05) / (lb + 0.05)
+}
+
+// The contrast ratio between text and the background it is on, from 1 to 21.
+// If the background is transparent, behind is what is behind it. Behind is black if it is empty.
+func ContrastRatio(foreground, background, behind string) (float64, error) {
+	fg, bg, err := resolvePair(foreground, background, behind)
+	if err != nil {
+		return 0, err
+	}
+	return contrast(fg, bg), nil
+}
+
+// Parse the colors of text on a background, and make them opaque
+func resolvePair(foreground, background, behind string) (rgba, rgba, error) {
+	back := rgba{0, 0, 0, 1}
+	if behind != "" {
+		b, err := parseCSSColor(behind)
+		if err != nil {
+			return rgba{}, rgba{}, err
+		}
+		back = b.over(rgba{0, 0, 0, 1})
+	}
+	bg, err := parseCSSColor(background)
+	if err != nil {
+		return rgba{}, rgba{}, err
+	}
+	bg = bg.over(back)
+	fg, err := parseCSSColor(foreground)
+	if err != nil {
+		return rgba{}, rgba{}, err
+	}
+	return fg.over(bg), bg, nil
+}
+
+// Change the lightness of the text color until it has enough contrast with the background.
+// The hue is kept, and black or white is used if no other lightness is enough.
+func readableOn(fg, bg rgba, min float64) rgba {
+	h, s, l := rgbToHSL(fg.r, fg.g, fg.b)
+	// Go lighter on dark backgrounds, and darker on light ones
+	step := 0.01
+	if contrast(rgba{1, 1, 1, 1}, bg) < contrast(rgba{0, 0, 0, 1}, bg) {
+		step = -step
+	}
+	for ; l >= 0 && l <= 1; l += step {
+		r, g, b := hslToRGB(h, s, l)
+		if c := (rgba{r, g, b, 1}); contrast(c, bg) >= min {
+			return c
+		}
+	}
+	if step > 0 {
+		return rgba{1, 1, 1, 1}
+	}
+	return rgba{0, 0, 0, 1}
+}
+
+// The pairs of text and background colors in a theme.
+// The names of the colors of the dark variant start with "dark.".
+func (t *Theme) colorPairs() []colorPair {
+	pairs := func(prefix string, cs, set *ColorScheme) []colorPair {
+		return []colorPair{
+			{prefix + "title_text", prefix + "darkgray", cs.TitleText, cs.Darkgray, "", &set.TitleText, contrastAALarge},
+			{prefix + "nicecolor", prefix + "darkgray", cs.Nicecolor, cs.Darkgray, "", &set.Nicecolor, contrastAALarge},
+			{prefix + "menu_link", "menu", cs.Menu_link, menuBackground, "", &set.Menu_link, contrastAA},
+			{prefix + "menu_hover", "menu", cs.Menu_hover, menuBackground, "", &set.Menu_hover, contrastAA},
+			{prefix + "menu_active", "menu", cs.Menu_active, menuBackground, "", &set.Menu_active, contrastAA},
+			{prefix + "content_text", prefix + "content_background", cs.Content_text, cs.Content_background, cs.Default_background, &set.Content_text, contrastAA},
+		}
+	}
+	all := pairs("", t.ColorScheme.withDefaults(), &t.ColorScheme)
+	if dark := t.ColorScheme.darkVariant(); dark != nil {
+		// Colors that are changed are set in the dark variant, also when they were the same as in the light variant
+		all = append(all, pairs("dark.", dark, t.ColorScheme.Dark)...)
+	}
+	return append(all, colorPair{"footer_text_color", "footer_color", t.FooterTextColor, t.FooterColor, "", &t.FooterTextColor, contrastAA})
+}
+
+// Find the text colors that do not have enough contrast with their background, for WCAG AA.
+// Colors that can not be parsed are reported with a ratio of 0.
+func (t *Theme) ContrastIssues() []ContrastIssue {
+	var issues []ContrastIssue
+	for _, p := range t.colorPairs() {
+		ratio, err := ContrastRatio(p.fg, p.bg, p.behind)
+		if err != nil {
+			ratio = 0
+		}
+		if ratio < p.min {
+			issues = append(issues, ContrastIssue{p.fgName, p.bgName, p.fg, p.bg, ratio, p.min})
+		}
+	}
+	return issues
+}
+
+// Change the text colors that do not have enough contrast with their background, so that they do.
+// Returns the issues that were fixed, with the colors as they were. Colors that can not be parsed are not changed.
+func (t *Theme) FixContrast() []ContrastIssue {
+	var fixed []ContrastIssue
+	for _, issue := range t.ContrastIssues() {
+		for _, p := range t.colorPairs() {
+			if p.fgName != issue.Foreground {
+				continue
+			}
+			fg, bg, err := resolvePair(p.fg, p.bg, p.behind)
+			if err != nil {
+				break
+			}
+			*p.set = readableOn(fg, bg, p.min).hex()
+			fixed = append(fixed, issue)
+			break
+		}
+	}
+	return fixed
+}
+
+// Generate a theme where all colors are derived from a base color, and optionally an accent color.
+// The hue of the base color is used for the backgrounds and the text, and the accent color for the highlights.
+// If no accent color is given, a more saturated and lighter variant of the base color is used.
+// The text colors are adjusted so that they meet WCAG AA, both for the light and the dark variant.
+func GenerateTheme(name, base, accent string) (*Theme, error) {
+	b, err := parseCSSColor(base)
+	if err != nil {
+		return nil, err
+	}
+	h, s, _ := rgbToHSL(b.r, b.g, b.b)
+	ah, as, al := h, math.Max(s, 0.55), 0.62
+	if accent != "" {
+		a, err := parseCSSColor(accent)
+		if err != nil {
+			return nil, err
+		}
+		ah, as, al = rgbToHSL(a.r, a.g, a.b)
+	}
+	// Backgrounds are only slightly tinted, even if the base color is saturated
+	tint := math.Min(s, 0.3)
+
+	t := DefaultTheme()
+	t.Name = name
+	t.ColorScheme = ColorScheme{
+		Darkgray:           hsl(h, tint, 0.13),
+		Nicecolor:          hsl(ah, as, al),
+		Menu_link:          hsl(h, tint/2, 0.78),
+		Menu_hover:         hsl(ah, as, 0.85),
+		Menu_active:        hsl(h, tint/2, 0.97),
+		Default_background: hsl(h, tint*2, 0.08),
+		TitleText:          hsl(h, tint/3, 0.88),
+		Content_background: hsl(h, tint/2, 0.97),
+		Content_text:       hsl(h, tint/2, 0.12),
+		Dark: &ColorScheme{
+			Default_background: hsl(h, tint*2, 0.04),
+			Content_background: hsl(h, tint/2, 0.12),
+			Content_text:       hsl(h, tint/3, 0.88),
+		},
+	}
+	t.FooterColor = hsl(h, tint, 0.06)
+	t.FooterTextColor = hsl(h, tint/2, 0.62)
+	t.FixContrast()
+	return t, nil
+}
@@ -0,0 +1,82 @@
+package genericsite
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestContrastRatio(t *testing.T) {
+	for _, tc := range []struct {
+		fg, bg, behind string
+		ratio          float64
+	}{
+		{"black", "white", "", 21},
+		{"#fff", "#fff", "", 1},
+		{"#777", "white", "", 4.48},
+		{"hsl(0, 0%, 100%)", "rgb(0 0 0)", "", 21},
+		// Half transparent white on black is gray
+		{"black", "rgba(255, 255, 255, 0.5)", "black", 5.28},
+	} {
+		ratio, err := ContrastRatio(tc.fg, tc.bg, tc.behind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(ratio-tc.ratio) > 0.01 {
+			t.Errorf("expected %s on %s to have a contrast ratio of %.2f, got %.2f", tc.fg, tc.bg, tc.ratio, ratio)
+		}
+	}
+	if _, err := ContrastRatio("currentcolor", "white", ""); err == nil {
+		t.Error("expected an error for a color that can not be computed")
+	}
+}
+
+func TestHSL(t *testing.T) {
+	for _, color := range []string{"#5080d0", "#ff0000", "#00ff80", "#123456", "#808080"} {
+		c, _ := parseCSSColor(color)
+		h, s, l := rgbToHSL(c.r, c.g, c.b)
+		if back := hsl(h, s, l); back != color {
+			t.Errorf("expected %s, got %s", color, back)
+		}
+	}
+}
+
+func TestContrastIssues(t *testing.T) {
+	// The title text of the default colors is dark gray on dark gray
+	theme := DefaultTheme()
+	issues := theme.ContrastIssues()
+	if len(issues) == 0 || issues[0].Foreground != "title_text" || !strings.Contains(issues[0].String(), "needs 3.0:1") {
+		t.Fatalf("expected the title text to be reported: %v", issues)
+	}
+	fixed := theme.FixContrast()
+	if len(fixed) != len(issues) {
+		t.Errorf("expected all issues to be fixed: %v", fixed)
+	}
+	if issues := theme.ContrastIssues(); len(issues) != 0 {
+		t.Errorf("expected no issues after fixing them: %v", issues)
+	}
+	if err := theme.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGenerateTheme(t *testing.T) {
+	for _, seed := range [][2]string{{"#5080d0", ""}, {"darkgreen", "orange"}, {"hsl(330, 90%, 50%)", ""}, {"white", ""}, {"black", "yellow"}} {
+		theme, err := GenerateTheme("generated", seed[0], seed[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := theme.Validate(); err != nil {
+			t.Error(err)
+		}
+		if issues := theme.ContrastIssues(); len(issues) != 0 {
+			t.Errorf("expected readable colors for %q: %v", seed, issues)
+		}
+		if theme.ColorScheme.Dark == nil {
+			t.Error("expected a dark variant")
+		}
+	}
+	if _, err := GenerateTheme("bad", "blurple", ""); err == nil {
+		t.Error("expected an error for an invalid base color")
+	}
+}
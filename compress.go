@@ -0,0 +1,113 @@
+package genericsite
+
+// Compression of responses, negotiated with Accept-Encoding
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Smaller responses are not worth compressing
+const minCompressSize = 256
+
+// Content with its compressed variants
+type variants struct {
+	data []byte
+	etag string
+	gzip []byte // nil if the data is compressed when needed
+	br   []byte // nil if there is no precompressed brotli file
+}
+
+var gzipWriters = sync.Pool{New: func() interface{} {
+	return gzip.NewWriter(nil)
+}}
+
+// Compress data with gzip
+func gzipData(data []byte) []byte {
+	var buf bytes.Buffer
+	gw := gzipWriters.Get().(*gzip.Writer)
+	gw.Reset(&buf)
+	gw.Write(data)
+	gw.Close()
+	gzipWriters.Put(gw)
+	return buf.Bytes()
+}
+
+// Content where the compressed variants are prepared in advance,
+// for content that is served many times
+func precompressed(data []byte, etag string) *variants {
+	v := &variants{data: data, etag: etag}
+	if len(data) >= minCompressSize {
+		v.gzip = gzipData(data)
+	}
+	return v
+}
+
+// Use precompressed files, filename.br and filename.gz, if they exist
+func (v *variants) loadCompressedFiles(filename string) {
+	if br, err := ioutil.ReadFile(filename + ".br"); err == nil {
+		v.br = br
+	}
+	if gz, err := ioutil.ReadFile(filename + ".gz"); err == nil {
+		v.gzip = gz
+	}
+}
+
+// Check if the client accepts the given encoding. An encoding with q=0 is not accepted.
+func acceptsEncoding(req *http.Request, encoding string) bool {
+	for _, part := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		name := strings.TrimSpace(fields[0])
+		if name != encoding && name != "*" {
+			continue
+		}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// The best encoding the client accepts, or "" for no compression
+func (v *variants) encoding(req *http.Request) string {
+	if v.br != nil && acceptsEncoding(req, "br") {
+		return "br"
+	}
+	if (v.gzip != nil || len(v.data) >= minCompressSize) && acceptsEncoding(req, "gzip") {
+		return "gzip"
+	}
+	return ""
+}
+
+// The content in the given encoding
+func (v *variants) body(encoding string) []byte {
+	switch encoding {
+	case "br":
+		return v.br
+	case "gzip":
+		if v.gzip == nil {
+			return gzipData(v.data)
+		}
+		return v.gzip
+	}
+	return v.data
+}
+
+// A compressed variant must have a different ETag than the uncompressed one
+func encodedETag(etag, encoding string) string {
+	if encoding == "" {
+		return etag
+	}
+	return strings.TrimSuffix(etag, "\"") + "-" + encoding + "\""
+}
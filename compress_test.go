@@ -0,0 +1,117 @@
+package genericsite
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	for header, expected := range map[string]bool{
+		"":                      false,
+		"gzip":                  true,
+		"deflate, gzip;q=0.5":   true,
+		"gzip;q=0, deflate":     false,
+		"*":                     true,
+		"br;q=1.0, identity":    false,
+		"deflate, GZIP-ish, br": false,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", header)
+		if acceptsEncoding(req, "gzip") != expected {
+			t.Errorf("gzip should be accepted %v for %q", expected, header)
+		}
+	}
+}
+
+func TestGzipPage(t *testing.T) {
+	cp := DefaultCP(nil)
+	cp.Url = "/page"
+	r := mux.NewRouter()
+	cp.Pub(r, newMemUserState(), cp.Url, "/css/menu.css", cp.ColorScheme, testTVGF()(newMemUserState()))
+
+	for _, url := range []string{"/page", "/css/style.css"} {
+		plain := get(r, url, nil)
+		compressed := get(r, url, map[string]string{"Accept-Encoding": "gzip"})
+		if compressed.Header().Get("Content-Encoding") != "gzip" || compressed.Header().Get("Vary") != "Accept-Encoding" {
+			t.Fatalf("expected %s to be compressed", url)
+		}
+		if compressed.Header().Get("ETag") == plain.Header().Get("ETag") {
+			t.Error("the compressed variant should have its own ETag")
+		}
+		gr, err := gzip.NewReader(compressed.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(gr)
+		// The time it took to serve the page differs
+		generatedIn := regexp.MustCompile("Generated in [^ ]+")
+		if err != nil || generatedIn.ReplaceAllString(string(data), "") != generatedIn.ReplaceAllString(plain.Body.String(), "") {
+			t.Errorf("the compressed %s should decompress to the uncompressed one", url)
+		}
+		if w := get(r, url, map[string]string{"Accept-Encoding": "gzip", "If-None-Match": compressed.Header().Get("ETag")}); w.Code != 304 {
+			t.Errorf("expected 304 for the compressed %s, got %d", url, w.Code)
+		}
+	}
+
+	small := NewRobots(nil, "")
+	small.ServePages(r)
+	if w := get(r, "/robots.txt", map[string]string{"Accept-Encoding": "gzip"}); w.Header().Get("Content-Encoding") != "" {
+		t.Error("small responses should not be compressed")
+	}
+}
+
+func TestPrecompressedAsset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "precompressed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "app.js")
+	ioutil.WriteFile(filename, []byte("alert('hi');"), 0644)
+	ioutil.WriteFile(filename+".br", []byte("pretend brotli"), 0644)
+
+	assets := NewAssets()
+	if err := assets.AddDir("/js", dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := assets.Get("/js/app.js.br"); ok {
+		t.Error("the precompressed file should not be an asset of its own")
+	}
+	asset, _ := assets.Get("/js/app.js")
+	r := mux.NewRouter()
+	assets.ServePages(r)
+	asset.ServeOriginal(r)
+
+	w := get(r, asset.URL(), map[string]string{"Accept-Encoding": "gzip, br"})
+	if w.Header().Get("Content-Encoding") != "br" || w.Body.String() != "pretend brotli" {
+		t.Error("expected the precompressed brotli file")
+	}
+	w = get(r, "/js/app.js", map[string]string{"Accept-Encoding": "gzip"})
+	if w.Header().Get("Content-Encoding") != "" || w.Body.String() != "alert('hi');" || w.Header().Get("Cache-Control") != shortCacheControl {
+		t.Error("expected the small uncompressed file at the original path")
+	}
+}
+
+func TestGzipStatus(t *testing.T) {
+	r := mux.NewRouter()
+	ServeAdmin(r, testBaseCP, newMemUserState(), testTVGF())
+	w := get(r, "/admin", map[string]string{"Accept-Encoding": "gzip"})
+	if w.Code != 403 || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected a compressed 403, got %d %q", w.Code, w.Header().Get("Content-Encoding"))
+	}
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadAll(gr); !strings.Contains(string(data), "Permission denied.") {
+		t.Error("expected the page")
+	}
+}
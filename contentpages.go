@@ -1,7 +1,6 @@
 package genericsite
 
 import (
-	"fmt"
 	"net/http"
 	"time"
 
@@ -20,6 +19,8 @@ type (
 		GeneratedCSSurl          string
 		ExtraCSSurls             []string
 		JqueryJSurl              string
+		JqueryIntegrity          string // Subresource Integrity hash for JqueryJSurl
+		JqueryFallbackURL        string // loaded if jQuery could not be loaded from JqueryJSurl
 		Faviconurl               string
 		BgImageURL               string
 		StretchBackground        bool
@@ -44,6 +45,24 @@ type (
 		GoogleFonts              []string
 		CustomSansSerif          string
 		CustomSerif              string
+		Language                 string // the language of the page, like "en", for screen readers
+		MobileMaxWidth           string // screens up to this width, like "40em", get the layout for phones. Empty disables it.
+
+		// For the sitemap
+		LastModified  time.Time
+		ChangeFreq    string  // "always", "hourly", "daily", "weekly", "monthly", "yearly" or "never"
+		Priority      float64 // from 0.0 to 1.0, 0 means that the priority is not given
+		RequiresLogin bool    // not listed in the sitemap, by default
+
+		// For the feeds
+		Published time.Time
+		Author    string
+		Summary   string // the start of the content is used if empty
+		RSSURL    string // linked to from every page, if not empty
+		AtomURL   string // linked to from every page, if not empty
+
+		// Rendered pages to keep, by template values, when published. 0 disables the cache.
+		RenderCacheSize int
 	}
 
 	// Content page generator
@@ -57,19 +76,35 @@ type (
 	UserInput string
 
 	ColorScheme struct {
-		Darkgray           string
-		Nicecolor          string
-		Menu_link          string
-		Menu_hover         string
-		Menu_active        string
-		Default_background string
-		TitleText          string
+		Darkgray           string `json:"darkgray"`
+		Nicecolor          string `json:"nicecolor"`
+		Menu_link          string `json:"menu_link"`
+		Menu_hover         string `json:"menu_hover"`
+		Menu_active        string `json:"menu_active"`
+		Default_background string `json:"default_background"`
+		TitleText          string `json:"title_text"`
+		Content_background string `json:"content_background"`
+		Content_text       string `json:"content_text"`
+
+		// Used when dark colors are preferred or chosen. Colors that are not set are the same as above.
+		Dark *ColorScheme `json:"dark,omitempty"`
 	}
 
 	// Base content page
 	BaseCP func(state pinterface.IUserState) *ContentPage
 
 	TemplateValueGeneratorFactory func(pinterface.IUserState) webhandle.TemplateValueGenerator
+
+	// What ServeSite has set up. Engines that are served separately can add their pages to the Sitemap,
+	// and should be given BaseCP, for the jQuery fallback.
+	Site struct {
+		BaseCP  BaseCP
+		Assets  *Assets
+		Sitemap *Sitemap
+		Robots  *Robots
+		Search  *SearchEngine
+		Feed    *Feed
+	}
 )
 
 // The default settings
@@ -78,7 +113,7 @@ func DefaultCP(userState pinterface.IUserState) *ContentPage {
 	var cp ContentPage
 	cp.GeneratedCSSurl = "/css/style.css"
 	cp.ExtraCSSurls = []string{"/css/menu.css"}
-	// TODO: fallback to local jquery.min.js, google how
+	// ServeSite sets up a fallback to the local copy
 	cp.JqueryJSurl = "//ajax.googleapis.com/ajax/libs/jquery/2.0.0/jquery.min.js" // "/js/jquery-2.0.0.js"
 	cp.Faviconurl = "/img/favicon.ico"
 	cp.ContentTitle = "NOP"
@@ -114,6 +149,15 @@ func DefaultCP(userState pinterface.IUserState) *ContentPage {
 	cs.Menu_active = "#ffffff" // white
 	cs.Default_background = "#000030"
 	cs.TitleText = "#303030"
+	cs.Content_background = defaultContentBackground
+	cs.Content_text = defaultContentText
+
+	// The content box is dark in the dark variant
+	cs.Dark = &ColorScheme{
+		Default_background: "#000010",
+		Content_background: "rgba(24,24,32,0.92)",
+		Content_text:       "#e0e0e0",
+	}
 
 	cp.ColorScheme = &cs
 
@@ -121,25 +165,34 @@ func DefaultCP(userState pinterface.IUserState) *ContentPage {
 	cp.CustomSansSerif = "" // Use the default sans serif
 	cp.CustomSerif = "IM Fell English SC"
 
+	cp.Language = "en"
+	cp.MobileMaxWidth = mobileMaxWidth
+
 	return &cp
 }
 
 func genericPageBuilder(cp *ContentPage) *onthefly.Page {
-	// TODO: Record the time from one step out, because content may be generated and inserted into this generated conten
-	startTime := time.Now()
-
 	page := onthefly.NewHTML5Page(cp.Title + " " + cp.Subtitle)
+	if root, err := page.GetTag("html"); err == nil && cp.Language != "" {
+		root.AddAttrib("lang", cp.Language)
+	}
 
 	page.LinkToCSS(cp.GeneratedCSSurl)
 	for _, cssurl := range cp.ExtraCSSurls {
 		page.LinkToCSS(cssurl)
 	}
-	page.LinkToJS(cp.JqueryJSurl)
+	AddScriptWithFallback(page, cp.JqueryJSurl, cp.JqueryIntegrity, cp.JqueryFallbackURL, "window.jQuery")
+	if cp.MobileMaxWidth != "" {
+		AddViewport(page)
+	}
 	page.LinkToFavicon(cp.Faviconurl)
+	AddFeedLinks(page, cp.Title, cp.RSSURL, cp.AtomURL)
+	addUserSettings(page)
 
 	onthefly.AddHeader(page, cp.HeaderJS)
 	onthefly.AddGoogleFonts(page, cp.GoogleFonts)
 	onthefly.AddBodyStyle(page, cp.BgImageURL, cp.StretchBackground)
+	AddSkipLink(page)
 	AddTopBox(page, cp.Title, cp.Subtitle, cp.SearchURL, cp.SearchButtonText, cp.BackgroundTextureURL, cp.RoundedLook, cp.ColorScheme, cp.SearchBox)
 
 	// TODO: Move the menubox into the TopBox
@@ -148,70 +201,160 @@ func genericPageBuilder(cp *ContentPage) *onthefly.Page {
 
 	AddContent(page, cp.ContentTitle, cp.ContentHTML+onthefly.DocumentReadyJS(cp.ContentJS))
 
-	elapsed := time.Since(startTime)
-	AddFooter(page, cp.FooterText, cp.FooterTextColor, cp.FooterColor, elapsed)
+	// The time it takes to serve the page is filled in for every request
+	AddFooter(page, cp.FooterText, cp.FooterTextColor, cp.FooterColor, 0)
+
+	if cp.ColorScheme != nil && cp.ColorScheme.Dark != nil {
+		AddColorSchemeToggle(page)
+	}
 
 	return page
 }
 
-// Publish a list of ContentPages, a colorscheme and template content
+// Publish a list of ContentPages, a colorscheme and template content.
+// Every page gets its own stylesheets, see PubWithOwnCSS.
 func PublishCPs(r *mux.Router, userState pinterface.IUserState, pc PageCollection, cs *ColorScheme, tvgf TemplateValueGeneratorFactory, cssurl string) {
 	// For each content page in the page collection
 	for _, cp := range pc {
-		// TODO: different css urls for all of these?
-		cp.Pub(r, userState, cp.Url, cssurl, cs, tvgf(userState))
+		cp.PubWithOwnCSS(r, userState, cssurl, cs, tvgf(userState))
 	}
+	// For pages that are not published here, but still link to cssurl
+	r.HandleFunc(cssurl, GenerateMenuCSS(userState, false, cs))
 }
 
-// Some Engines like Admin must be served separately
+// Some Engines like Admin must be served separately, see ServeAuth and ServeAdmin
 // jquerypath is ie "/js/jquery.2.0.0.js", will then serve the file at static/js/jquery.2.0.0.js
-func ServeSite(r *mux.Router, basecp BaseCP, userState pinterface.IUserState, cps PageCollection, tvgf TemplateValueGeneratorFactory, jquerypath string) {
-	cs := basecp(userState).ColorScheme
-	PublishCPs(r, userState, cps, cs, tvgf, "/css/menu.css")
+func ServeSite(r *mux.Router, basecp BaseCP, userState pinterface.IUserState, cps PageCollection, tvgf TemplateValueGeneratorFactory, jquerypath string) *Site {
+	assets := NewAssets()
+	if jquery, err := assets.AddFile(jquerypath, "static"+jquerypath); err == nil {
+		// Load the local copy if jQuery can not be loaded from the CDN.
+		// The integrity hash for the CDN can be set as JqueryIntegrity in the base content page.
+		basecp = jquery.JqueryFallbackCP(basecp, "")
+		pages := make(PageCollection, len(cps))
+		copy(pages, cps)
+		for i := range pages {
+			jquery.UseAsJqueryFallback(&pages[i], "")
+		}
+		cps = pages
+		jquery.ServeOriginal(r)
+	} else {
+		webhandle.Publish(r, jquerypath, "static"+jquerypath)
+	}
+	assets.ServePages(r)
+
+	// Time the requests from when they arrive
+	r.Use(TimingMiddleware)
+
+	basepage := basecp(userState)
+	PublishCPs(r, userState, cps, basepage.ColorScheme, tvgf, "/css/menu.css")
+
+	// Every page has a search box
+	se := ServeSearch(r, basecp, userState, cps, tvgf)
+
+	sm := NewSitemap()
+	sm.AddPages(cps)
+	sm.ServePages(r)
+
+	// static/various/robots.txt is served instead, if it exists
+	rb := NewRobots(sm, "static/various/robots.txt")
+	rb.ServePages(r)
 
-	// TODO: Add fallback to this local version
-	webhandle.Publish(r, jquerypath, "static"+jquerypath)
+	// Serve a feed of the pages, if the base content page links to one
+	feed := NewFeed(basepage.Title, basepage.Subtitle, cps)
+	feed.ServePages(r, basepage.RSSURL, basepage.AtomURL)
 
-	// TODO: Generate these
-	webhandle.Publish(r, "/robots.txt", "static/various/robots.txt")
-	webhandle.Publish(r, "/sitemap_index.xml", "static/various/sitemap_index.xml")
+	return &Site{basecp, assets, sm, rb, se, feed}
 }
 
-// Create a web.go compatible function that returns a string that is the HTML for this page
+// Create a web.go compatible function that returns a string that is the HTML for this page.
+// The page is compiled once, see CompileHTMLwithTemplate.
 func GenerateHTMLwithTemplate(page *onthefly.Page, tvg webhandle.TemplateValueGenerator) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, req *http.Request) {
-		values := tvg(w, req)
-		fmt.Fprintf(w, "%s", mustache.Render(page.GetXML(true), values))
-	}
+	return CompileHTMLwithTemplate(page, tvg, 0)
 }
 
 // CSS for the menu, and a bit more
-func GenerateMenuCSS(state pinterface.IUserState, stretchBackground bool, cs *ColorScheme) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, req *http.Request) {
-		w.Header().Add("Content-Type", "text/css")
-
-		// one of the extra css files that are loaded after the main style
-		retval := mustache.Render(menustyle_tmpl, cs)
+func MenuCSS(stretchBackground bool, cs *ColorScheme) string {
+	// one of the extra css files that are loaded after the main style
+	retval := ColorSchemeCSS(cs) + mustache.Render(menustyle_tmpl, cs)
+
+	// The load order of background-color, background-size and background-image
+	// is actually significant in some browsers! Do not reorder lightly.
+	if stretchBackground {
+		retval = "body {\nbackground-color: " + colorVar("default_background", cs.Default_background) + ";\nbackground-size: cover;\n}\n" + retval
+	} else {
+		retval = "body {\nbackground-color: " + colorVar("default_background", cs.Default_background) + ";\n}\n" + retval
+	}
+	retval += ".titletext { display: inline; }"
 
-		// The load order of background-color, background-size and background-image
-		// is actually significant in some browsers! Do not reorder lightly.
-		if stretchBackground {
-			retval = "body {\nbackground-color: " + cs.Default_background + ";\nbackground-size: cover;\n}\n" + retval
-		} else {
-			retval = "body {\nbackground-color: " + cs.Default_background + ";\n}\n" + retval
-		}
-		retval += ".titletext { display: inline; }"
+	return retval
+}
 
-		fmt.Fprintf(w, "%s", retval)
-	}
+// Serve the CSS for the menu, with caching headers.
+// It is the same for every user, the settings of the logged-in user are in a stylesheet of their own.
+func GenerateMenuCSS(state pinterface.IUserState, stretchBackground bool, cs *ColorScheme) func(http.ResponseWriter, *http.Request) {
+	return serveCSS(MenuCSS(stretchBackground, cs), time.Now())
 }
 
 // Make an html and css page available
 func (cp *ContentPage) Pub(r *mux.Router, userState pinterface.IUserState, url, cssurl string, cs *ColorScheme, tvg webhandle.TemplateValueGenerator) {
 	genericpage := genericPageBuilder(cp)
-	r.HandleFunc(url, GenerateHTMLwithTemplate(genericpage, tvg))
-	r.HandleFunc(cp.GeneratedCSSurl, webhandle.GenerateCSS(genericpage))
+	r.HandleFunc(url, cp.compile(genericpage).Handler(UserSettingsValues(userState, tvg)))
+	r.HandleFunc(cp.GeneratedCSSurl, serveCSS(cp.pageCSS(genericpage), cp.cssModified()))
 	r.HandleFunc(cssurl, GenerateMenuCSS(userState, cp.StretchBackground, cs))
+	styleSheets.ServePages(r)
+}
+
+// Make an html page available, with stylesheets that are addressed by the hash of their contents,
+// so that pages with different looks don't overwrite each others stylesheets.
+// cssurl in ExtraCSSurls is replaced with the menu CSS for this page.
+// The ColorScheme of the page is used for the menu, if set, otherwise the given one.
+func (cp *ContentPage) PubWithOwnCSS(r *mux.Router, userState pinterface.IUserState, cssurl string, cs *ColorScheme, tvg webhandle.TemplateValueGenerator) {
+	if cp.ColorScheme != nil {
+		cs = cp.ColorScheme
+	}
+	menuCSSurl := styleSheets.Add(MenuCSS(cp.StretchBackground, cs))
+	extraCSSurls := make([]string, len(cp.ExtraCSSurls))
+	for i, url := range cp.ExtraCSSurls {
+		if url == cssurl {
+			url = menuCSSurl
+		}
+		extraCSSurls[i] = url
+	}
+	cp.ExtraCSSurls = extraCSSurls
+
+	cp.useGeneratedCSS()
+	r.HandleFunc(cp.Url, cp.compile(genericPageBuilder(cp)).Handler(UserSettingsValues(userState, tvg)))
+	styleSheets.ServePages(r)
+}
+
+// Compile the page that has been built for this content page
+func (cp *ContentPage) compile(page *onthefly.Page) *CompiledPage {
+	return CompilePage(page, cp.RenderCacheSize)
+}
+
+// The Last-Modified time of the generated CSS. LastModified is used, if set.
+// The HTML has no Last-Modified, since it is rendered differently for each user.
+func (cp *ContentPage) cssModified() time.Time {
+	if !cp.LastModified.IsZero() {
+		return cp.LastModified
+	}
+	return time.Now()
+}
+
+// Link to a stylesheet that is addressed by the hash of the CSS that is generated for this page.
+// The links to the stylesheets and the contents are not part of the CSS, so the CSS stays the same when they change.
+func (cp *ContentPage) useGeneratedCSS() {
+	cp.GeneratedCSSurl = styleSheets.Add(cp.pageCSS(genericPageBuilder(cp)))
+}
+
+// The CSS for a page that has been built for this content page.
+// The layout for phones comes last, so that it overrides the layout for larger screens.
+func (cp *ContentPage) pageCSS(page *onthefly.Page) string {
+	css := CanonicalCSS(page.GetCSS())
+	if cp.MobileMaxWidth != "" {
+		css += ResponsiveCSS(cp.MobileMaxWidth)
+	}
+	return css
 }
 
 // TODO: Write a function for rendering a StandaloneTag inside a Page by the use of template {{{placeholders}}}
@@ -224,32 +367,48 @@ func RenderPage(page *onthefly.Page, templateContents map[string]string) (string
 
 // Wrap a lonely string in an entire webpage
 func (cp *ContentPage) Surround(s string, templateContents map[string]string) (string, string) {
-	cp.ContentHTML = s
-	page := genericPageBuilder(cp)
-	return RenderPage(page, templateContents)
+	// Concurrent requests must not modify the same page
+	page := *cp
+	page.ContentHTML = s
+	return RenderPage(genericPageBuilder(&page), templateContents)
+}
+
+// Generate the CSS for a page that is wrapped around dynamic contents, and serve it.
+// The CSS and the HTML around the contents do not depend on the contents,
+// so they are only generated once, when setting up the handler.
+// The contents are inserted as they are, and are not parsed as a template.
+func (cp *ContentPage) wrapped(r *mux.Router) *CompiledPage {
+	page := *cp
+	page.useGeneratedCSS()
+	page.ContentHTML = "{{{" + wrappedContentKey + "}}}"
+	styleSheets.ServePages(r)
+	return CompilePage(genericPageBuilder(&page), 0)
 }
 
 // Uses a given WebHandle as the contents for the the ContentPage contents
 func (cp *ContentPage) WrapWebHandle(r *mux.Router, wh func(string) string, tvg webhandle.TemplateValueGenerator) func(string, http.ResponseWriter, *http.Request) {
+	cpage := cp.wrapped(r)
+	tvg = UserSettingsValues(cp.UserState, tvg)
 	return func(val string, w http.ResponseWriter, req *http.Request) {
-		html, css := cp.Surround(wh(val), tvg(w, req))
-		r.HandleFunc(cp.GeneratedCSSurl, func(w http.ResponseWriter, req *http.Request) {
-			w.Header().Add("Content-Type", "text/css")
-			fmt.Fprintf(w, "%s", css)
-		})
-		fmt.Fprintf(w, "%s", html)
+		rt, req := timingFor(req)
+		done := rt.Measure("content")
+		content := wh(val)
+		done()
+		cpage.serveWrapped(w, req, rt, http.StatusOK, content, tvg)
 	}
 }
 
 // Uses a given SimpleContextHandle as the contents for the the ContentPage contents
 func (cp *ContentPage) WrapSimpleContextHandle(r *mux.Router, sch func(w http.ResponseWriter, req *http.Request) string, tvg webhandle.TemplateValueGenerator) func(w http.ResponseWriter, req *http.Request) {
+	cpage := cp.wrapped(r)
+	tvg = UserSettingsValues(cp.UserState, tvg)
 	return func(w http.ResponseWriter, req *http.Request) {
-		html, css := cp.Surround(sch(w, req), tvg(w, req))
-		r.HandleFunc(cp.GeneratedCSSurl, func(w http.ResponseWriter, req *http.Request) {
-			w.Header().Add("Content-Type", "text/css")
-			fmt.Fprintf(w, "%s", css)
-		})
-		fmt.Fprintf(w, "%s", html)
+		rt, req := timingFor(req)
+		sr := &statusRecorder{w, 0}
+		done := rt.Measure("content")
+		content := sch(sr, req)
+		done()
+		cpage.serveWrapped(w, req, rt, sr.statusOrOK(), content, tvg)
 	}
 }
 
@@ -262,23 +421,24 @@ a {
 }
 
 a:link {
-  color: {{Menu_link}};
+  color: var(--menu-link, {{Menu_link}});
 }
 
 a:visited {
-  color: {{Menu_link}};
+  color: var(--menu-link, {{Menu_link}});
 }
 
 a:hover {
-  color: {{Menu_hover}};
+  color: var(--menu-hover, {{Menu_hover}});
 }
 
 a:active {
-  color: {{Menu_active}};
+  color: var(--menu-active, {{Menu_active}});
 }
 
 .menuEntry {
   display: inline;
+  position: relative;
 }
 
 .menuList {
@@ -291,4 +451,63 @@ a:active {
   display: inline;
   color: #a0a0a0;
 }
+
+.submenutoggle {
+  padding: 0 0.3em;
+  border: none;
+  background: transparent;
+  color: var(--menu-link, {{Menu_link}});
+  font: inherit;
+  cursor: pointer;
+}
+
+.submenu {
+  display: none;
+  position: absolute;
+  top: 100%;
+  left: 0;
+  z-index: 5;
+  min-width: 10em;
+  margin: 0;
+  padding: 0.3em 0;
+  list-style-type: none;
+  background-color: var(--darkgray, {{Darkgray}});
+  box-shadow: 1px 3px 5px rgba(0,0,0, .8);
+}
+
+.submenu .submenu {
+  top: 0;
+  left: 100%;
+}
+
+.submenuEntry {
+  display: block;
+  position: relative;
+  padding: 0.3em 1em;
+  white-space: nowrap;
+}
+
+.open > .submenu {
+  display: block;
+}
+
+/* Touch screens open the submenus with the buttons only */
+@media (hover: hover) {
+  .menuEntry:hover > .submenu, .submenuEntry:hover > .submenu {
+    display: block;
+  }
+}
+
+a:focus-visible, button:focus-visible, input:focus-visible, select:focus-visible, textarea:focus-visible {
+  outline: 2px solid var(--nicecolor, {{Nicecolor}});
+  outline-offset: 2px;
+}
+
+#skiplink:focus {
+  left: 1em;
+  top: 1em;
+  padding: 0.5em 1em;
+  background-color: var(--content-background, white);
+  color: var(--content-text, black);
+}
 `
@@ -0,0 +1,103 @@
+package genericsite
+
+// Tokens in the forms that change something, so that other sites can not post them on behalf of a logged-in user
+
+import (
+	"crypto/subtle"
+	"errors"
+	"html"
+	"net/http"
+
+	"github.com/xyproto/pinterface"
+	"github.com/xyproto/webhandle"
+)
+
+const (
+	// Field name in the Users() hash map, and the name of the form field
+	csrfTokenField = "csrftoken"
+
+	// The cookie with the token for the login form, since there is no logged-in user yet
+	loginTokenCookie = "logintoken"
+
+	// Shown when a form is posted without the right token
+	csrfMessage = "The form has expired or was not sent from this site. Please try again."
+)
+
+// The token for the forms of the given user. It is created when it is first needed,
+// and removed when the user logs in or out, so that every session gets a new one.
+func csrfToken(state pinterface.IUserState, username string) (string, error) {
+	if username == "" {
+		return "", errors.New("not logged in")
+	}
+	users := state.Users()
+	if token, err := users.Get(username, csrfTokenField); err == nil && token != "" {
+		return token, nil
+	}
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	if err := users.Set(username, csrfTokenField, token); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Remove the token of the given user, at the end of a session
+func removeCSRFToken(state pinterface.IUserState, username string) {
+	state.Users().DelKey(username, csrfTokenField)
+}
+
+// A hidden form field with the token of the logged-in user.
+// Every form that is checked with ValidCSRF must have it.
+func CSRFField(state pinterface.IUserState, req *http.Request) string {
+	token, err := csrfToken(state, state.Username(req))
+	if err != nil {
+		return ""
+	}
+	return "<input type=\"hidden\" name=\"" + csrfTokenField + "\" value=\"" + html.EscapeString(token) + "\">"
+}
+
+// Check that a posted form has the token of the logged-in user
+func ValidCSRF(state pinterface.IUserState, req *http.Request) bool {
+	username := state.Username(req)
+	if username == "" {
+		return false
+	}
+	stored, err := state.Users().Get(username, csrfTokenField)
+	if err != nil || stored == "" {
+		return false
+	}
+	posted := webhandle.GetFormParam(req, csrfTokenField)
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(posted)) == 1
+}
+
+// A hidden form field for the login form. There is no user to store the token for yet,
+// so the same token is set as a cookie, and ValidLoginCSRF checks that they match.
+func LoginCSRFField(w http.ResponseWriter, req *http.Request) string {
+	var token string
+	if c, err := req.Cookie(loginTokenCookie); err == nil && c.Value != "" {
+		token = c.Value
+	} else {
+		if token, err = randomToken(); err != nil {
+			return ""
+		}
+		http.SetCookie(w, &http.Cookie{Name: loginTokenCookie, Value: token, Path: "/login", HttpOnly: true, Secure: req.TLS != nil})
+	}
+	return "<input type=\"hidden\" name=\"" + csrfTokenField + "\" value=\"" + html.EscapeString(token) + "\">"
+}
+
+// Check that a posted login form has the same token as the cookie from LoginCSRFField
+func ValidLoginCSRF(req *http.Request) bool {
+	c, err := req.Cookie(loginTokenCookie)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	posted := webhandle.GetFormParam(req, csrfTokenField)
+	return subtle.ConstantTimeCompare([]byte(c.Value), []byte(posted)) == 1
+}
+
+// Remove the cookie with the token for the login form, after logging in
+func removeLoginCSRFCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: loginTokenCookie, Value: "", Path: "/login", MaxAge: -1, HttpOnly: true})
+}
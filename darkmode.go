@@ -0,0 +1,160 @@
+package genericsite
+
+// Light and dark variants of color schemes, switched with prefers-color-scheme or a toggle
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/xyproto/onthefly"
+)
+
+const (
+	// Colors of the content box, for color schemes that do not set them
+	defaultContentBackground = "rgba(255,255,255,0.92)"
+	defaultContentText       = "black"
+
+	// The chosen color scheme is stored in localStorage with this key, and set as data-theme on the html tag
+	colorSchemeStorageKey = "colorscheme"
+
+	// Use the stored choice before the page is shown, so that the page does not flash in the other colors
+	// A color scheme that is set in the settings of the logged-in user is not overridden.
+	colorSchemeInitJS = `try { var colorscheme = localStorage.getItem("` + colorSchemeStorageKey + `"); if (colorscheme && !document.documentElement.getAttribute("data-theme")) { document.documentElement.setAttribute("data-theme", colorscheme); } } catch (e) {}`
+
+	// Switch to the other color scheme than the one that is shown, and remember the choice
+	colorSchemeToggleJS = `function toggleColorScheme() {
+  var root = document.documentElement;
+  var current = root.getAttribute("data-theme");
+  if (!current) {
+    current = (window.matchMedia && window.matchMedia("(prefers-color-scheme: dark)").matches) ? "dark" : "light";
+  }
+  var next = (current === "dark") ? "light" : "dark";
+  root.setAttribute("data-theme", next);
+  try { localStorage.setItem("` + colorSchemeStorageKey + `", next); } catch (e) {}
+}`
+)
+
+type namedColor struct {
+	name, value string
+}
+
+// The colors of the color scheme, by the names that are used in theme files
+func (cs *ColorScheme) colors() []namedColor {
+	return []namedColor{
+		{"darkgray", cs.Darkgray},
+		{"nicecolor", cs.Nicecolor},
+		{"menu_link", cs.Menu_link},
+		{"menu_hover", cs.Menu_hover},
+		{"menu_active", cs.Menu_active},
+		{"default_background", cs.Default_background},
+		{"title_text", cs.TitleText},
+		{"content_background", cs.Content_background},
+		{"content_text", cs.Content_text},
+	}
+}
+
+// The color scheme, with the default colors of the content box if they are not set
+func (cs *ColorScheme) withDefaults() *ColorScheme {
+	c := *cs
+	if c.Content_background == "" {
+		c.Content_background = defaultContentBackground
+	}
+	if c.Content_text == "" {
+		c.Content_text = defaultContentText
+	}
+	return &c
+}
+
+// The dark variant, where the colors that are not set are the same as for the light variant.
+// Returns nil if there is no dark variant.
+func (cs *ColorScheme) darkVariant() *ColorScheme {
+	if cs.Dark == nil {
+		return nil
+	}
+	c := *cs.withDefaults()
+	d := cs.Dark
+	for _, pair := range []struct {
+		dst *string
+		src string
+	}{
+		{&c.Darkgray, d.Darkgray},
+		{&c.Nicecolor, d.Nicecolor},
+		{&c.Menu_link, d.Menu_link},
+		{&c.Menu_hover, d.Menu_hover},
+		{&c.Menu_active, d.Menu_active},
+		{&c.Default_background, d.Default_background},
+		{&c.TitleText, d.TitleText},
+		{&c.Content_background, d.Content_background},
+		{&c.Content_text, d.Content_text},
+	} {
+		if pair.src != "" {
+			*pair.dst = pair.src
+		}
+	}
+	c.Dark = nil
+	return &c
+}
+
+// The custom property for a color, with a fallback
+func colorVar(name, fallback string) string {
+	return "var(--" + strings.Replace(name, "_", "-", -1) + ", " + fallback + ")"
+}
+
+// Write the colors as custom properties
+func writeColorVariables(buf *bytes.Buffer, selector, colorScheme string, cs *ColorScheme) {
+	buf.WriteString(selector + " {\n")
+	buf.WriteString("color-scheme: " + colorScheme + ";\n")
+	for _, c := range cs.colors() {
+		buf.WriteString("--" + strings.Replace(c.name, "_", "-", -1) + ": " + c.value + ";\n")
+	}
+	buf.WriteString("}\n")
+}
+
+// CSS that defines the colors as custom properties. If there is a dark variant, it is used when the browser
+// prefers a dark color scheme, unless the light one has been chosen with the toggle, or when the dark one has been chosen.
+func ColorSchemeCSS(cs *ColorScheme) string {
+	return colorSchemeCSS(cs, ":root")
+}
+
+// CSS that defines the colors as custom properties, with the given selector for the light variant
+func colorSchemeCSS(cs *ColorScheme, lightSelector string) string {
+	var buf bytes.Buffer
+	writeColorVariables(&buf, lightSelector, "light", cs.withDefaults())
+	if dark := cs.darkVariant(); dark != nil {
+		buf.WriteString("@media (prefers-color-scheme: dark) {\n")
+		writeColorVariables(&buf, ":root:not([data-theme=\"light\"])", "dark", dark)
+		buf.WriteString("}\n")
+		writeColorVariables(&buf, ":root[data-theme=\"dark\"]", "dark", dark)
+	}
+	return buf.String()
+}
+
+// Add a button that switches between the light and dark color scheme.
+// The choice overrides the preference of the browser, and is remembered.
+func AddColorSchemeToggle(page *onthefly.Page) (*onthefly.Tag, error) {
+	if _, err := page.AddScriptToHead(colorSchemeInitJS + "\n" + colorSchemeToggleJS); err != nil {
+		return nil, err
+	}
+	body, err := page.GetTag("body")
+	if err != nil {
+		return nil, err
+	}
+	button := body.AddNewTag("button")
+	button.AddAttrib("id", "colorschemetoggle")
+	button.AddAttrib("type", "button")
+	button.AddAttrib("title", "Switch between light and dark colors")
+	button.AddAttrib("aria-label", "Switch between light and dark colors")
+	button.AddAttrib("onclick", "toggleColorScheme()")
+	button.AddStyle("position", "fixed")
+	button.AddStyle("top", "0.5em")
+	button.AddStyle("right", "0.5em")
+	button.AddStyle("z-index", "3")
+	button.AddStyle("border", "none")
+	button.AddStyle("background", "transparent")
+	button.AddStyle("color", colorVar("menu_link", "#c0c0c0"))
+	button.AddStyle("cursor", "pointer")
+	button.AddStyle("font-size", "1.2em")
+	// Half of a circle, filled
+	button.AddContent("&#9680;")
+	return button, nil
+}
@@ -0,0 +1,72 @@
+package genericsite
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestColorSchemeCSS(t *testing.T) {
+	cs := DefaultCP(nil).ColorScheme
+	css := ColorSchemeCSS(cs)
+	for _, s := range []string{
+		"--darkgray: #202020;",
+		"@media (prefers-color-scheme: dark) {\n:root:not([data-theme=\"light\"]) {",
+		":root[data-theme=\"dark\"] {",
+		"--content-text: #e0e0e0;",
+		"color-scheme: dark;",
+	} {
+		if !strings.Contains(css, s) {
+			t.Errorf("expected %q in the CSS:\n%s", s, css)
+		}
+	}
+	// Colors that are not set in the dark variant are the same as in the light variant
+	dark := css[strings.Index(css, ":root[data-theme=\"dark\"]"):]
+	if !strings.Contains(dark, "--darkgray: #202020;") {
+		t.Error("expected the dark variant to use the light colors that are not set: " + dark)
+	}
+
+	light := ColorSchemeCSS(&ColorScheme{Default_background: "white"})
+	if strings.Contains(light, "prefers-color-scheme") || !strings.Contains(light, "--content-background: "+defaultContentBackground+";") {
+		t.Error("unexpected CSS for a color scheme without a dark variant: " + light)
+	}
+}
+
+func TestColorSchemeToggle(t *testing.T) {
+	cp := DefaultCP(nil)
+	if html := genericPageBuilder(cp).String(); !strings.Contains(html, "toggleColorScheme()") {
+		t.Error("expected a toggle for a color scheme with a dark variant")
+	}
+	if css := genericPageBuilder(cp).GetCSS(); !strings.Contains(css, "var(--content-background, ") {
+		t.Error("expected the content box to use the custom properties: " + css)
+	}
+	cp.ColorScheme.Dark = nil
+	if html := genericPageBuilder(cp).String(); strings.Contains(html, "toggleColorScheme()") {
+		t.Error("expected no toggle when there is no dark variant")
+	}
+}
+
+func TestDarkThemeTOML(t *testing.T) {
+	theme, err := ParseThemeTOML([]byte("[colors]\ncontent_background = \"white\"\n\n[colors.dark]\ncontent_background = \"#111\"\n"), "night")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if theme.ColorScheme.Content_background != "white" || theme.ColorScheme.Dark.Content_background != "#111" {
+		t.Errorf("unexpected colors: %+v", theme.ColorScheme)
+	}
+	if _, err := ParseThemeTOML([]byte("[colors.dark]\ncontent_text = \"nope\"\n"), "bad"); err == nil || !strings.Contains(err.Error(), "dark.content_text") {
+		t.Errorf("expected the invalid dark color to be reported, got %v", err)
+	}
+}
+
+func TestDarkThemeJSON(t *testing.T) {
+	theme, err := ParseThemeJSON([]byte(`{"colors": {"content_background": "white", "dark": {"content_background": "#111"}}}`), "night")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if theme.ColorScheme.Content_background != "white" || theme.ColorScheme.Dark.Content_background != "#111" {
+		t.Errorf("unexpected colors: %+v", theme.ColorScheme)
+	}
+	if _, err := ParseThemeJSON([]byte(`{"colors": {"dark": {"content_text": "nope"}}}`), "bad"); err == nil || !strings.Contains(err.Error(), "dark.content_text") {
+		t.Errorf("expected the invalid dark color to be reported, got %v", err)
+	}
+}
@@ -1,32 +1,293 @@
 package genericsite
 
 import (
-	"net/smtp"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/drbawb/mustache"
 )
 
-// TODO: Forgot password email
-// TODO: Forgot username email
-// TODO: "click here if you have not asked for this"
+type (
+	// An email template. All fields are mustache templates.
+	// The HTML is placed within the HTML layout of the email.
+	EmailTemplate struct {
+		Subject string
+		Text    string
+		HTML    string
+	}
+
+	// Email templates, by name
+	EmailTemplates map[string]*EmailTemplate
+
+	// For sending email that looks like the rest of the site
+	EmailSettings struct {
+		Title       string // the name of the site, the domain is used if empty
+		ColorScheme *ColorScheme
+		FooterText  string
+		Layout      string // mustache template for the HTML part, {{{content}}} is the HTML of the EmailTemplate
+		Templates   EmailTemplates
+	}
+)
+
+// Used by ConfirmationEmail, ResetPasswordEmail and ForgotUsernameEmail
+var defaultEmailSettings = &EmailSettings{Layout: emailLayout_tmpl, Templates: DefaultEmailTemplates()}
+
+// Email settings that are styled after the given content page
+func NewEmailSettings(cp *ContentPage) *EmailSettings {
+	return &EmailSettings{
+		Title:       cp.Title,
+		ColorScheme: cp.ColorScheme,
+		FooterText:  cp.FooterText,
+		Layout:      emailLayout_tmpl,
+		Templates:   DefaultEmailTemplates(),
+	}
+}
+
+// The default email templates: "confirmation", "resetpassword" and "forgotusername"
+func DefaultEmailTemplates() EmailTemplates {
+	return EmailTemplates{
+		"confirmation": &EmailTemplate{
+			Subject: "Welcome, {{{username}}}",
+			Text:    confirmationText_tmpl,
+			HTML:    confirmationHTML_tmpl,
+		},
+		"resetpassword": &EmailTemplate{
+			Subject: "Password reset for {{{title}}}",
+			Text:    resetPasswordText_tmpl,
+			HTML:    resetPasswordHTML_tmpl,
+		},
+		"forgotusername": &EmailTemplate{
+			Subject: "Your username at {{{title}}}",
+			Text:    forgotUsernameText_tmpl,
+			HTML:    forgotUsernameHTML_tmpl,
+		},
+	}
+}
+
+// Write a header field, with the value encoded if it is not plain ASCII
+func writeHeader(buf *bytes.Buffer, key, value string) {
+	buf.WriteString(key + ": " + mime.QEncoding.Encode("utf-8", value) + "\r\n")
+}
+
+// Convert all line endings to CRLF
+func crlf(s string) string {
+	return strings.Replace(strings.Replace(s, "\r\n", "\n", -1), "\n", "\r\n", -1)
+}
+
+// Generate a unique Message-ID for the given domain
+func messageID(domain string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">", nil
+}
+
+// Add a quoted-printable part to a multipart message
+func writePart(mw *multipart.Writer, contentType, content string) error {
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", contentType+"; charset=utf-8")
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	pw, err := mw.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	qw := quotedprintable.NewWriter(pw)
+	if _, err := qw.Write([]byte(crlf(content))); err != nil {
+		return err
+	}
+	return qw.Close()
+}
+
+// Compose a multipart/alternative email with a plain text and an HTML part
+func composeEmail(from, to *mail.Address, domain, subject, text, html string) ([]byte, error) {
+	id, err := messageID(domain)
+	if err != nil {
+		return nil, err
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	// The preferred alternative comes last
+	if err := writePart(mw, "text/plain", text); err != nil {
+		return nil, err
+	}
+	if err := writePart(mw, "text/html", html); err != nil {
+		return nil, err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("From: " + from.String() + "\r\n")
+	buf.WriteString("To: " + to.String() + "\r\n")
+	writeHeader(&buf, "Subject", subject)
+	buf.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	buf.WriteString("Message-ID: " + id + "\r\n")
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: multipart/alternative; boundary=\"" + mw.Boundary() + "\"\r\n")
+	buf.WriteString("\r\n")
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
+
+// Render the named template and compose an email from noreply@domain to the given address.
+// The values are available in the templates, together with "title", "domain" and the colors of the ColorScheme.
+func (es *EmailSettings) Compose(name, domain, email string, values map[string]interface{}) (from, to *mail.Address, msg []byte, err error) {
+	tmpl, ok := es.Templates[name]
+	if !ok {
+		return nil, nil, nil, errors.New("no such email template: " + name)
+	}
+	to, err = mail.ParseAddress(email)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	title := es.Title
+	if title == "" {
+		title = domain
+	}
+	from = &mail.Address{Name: title, Address: "noreply@" + domain}
+
+	context := map[string]interface{}{"title": title, "domain": domain, "footer": es.FooterText}
+	for key, value := range values {
+		context[key] = value
+	}
+	cs := es.ColorScheme
+	if cs == nil {
+		cs = DefaultCP(nil).ColorScheme
+	}
+
+	subject := mustache.Render(tmpl.Subject, context)
+	text := mustache.Render(tmpl.Text, context)
+	context["content"] = mustache.Render(tmpl.HTML, context, cs)
+	context["subject"] = subject
+	html := mustache.Render(es.Layout, context, cs)
+
+	msg, err = composeEmail(from, to, domain, subject, text, html)
+	return from, to, msg, err
+}
+
+// Render the named template and send the email with the current Mailer
+func (es *EmailSettings) Send(name, domain, email string, values map[string]interface{}) error {
+	from, to, msg, err := es.Compose(name, domain, email, values)
+	if err != nil {
+		return err
+	}
+	return CurrentMailer().Send(from.Address, []string{to.Address}, msg)
+}
+
+func (es *EmailSettings) ConfirmationEmail(domain, link, username, email string) error {
+	return es.Send("confirmation", domain, email, map[string]interface{}{"link": link, "username": username})
+}
+
+func (es *EmailSettings) ResetPasswordEmail(domain, link, username, email string) error {
+	return es.Send("resetpassword", domain, email, map[string]interface{}{"link": link, "username": username})
+}
+
+func (es *EmailSettings) ForgotUsernameEmail(domain string, usernames []string, email string) error {
+	return es.Send("forgotusername", domain, email, map[string]interface{}{"usernames": usernames, "several": len(usernames) > 1})
+}
 
 func ConfirmationEmail(domain, link, username, email string) error {
-	host := "localhost"
-	auth := smtp.PlainAuth("", "", "", host)
-	msgString := "From: " + domain + " <noreply@" + domain + ">\n"
-	msgString += "To: " + email + "\n"
-	msgString += "Subject: Welcome, " + username + "\n"
-	msgString += "\n"
-	msgString += "Hi and welcome to " + domain + "!\n"
-	msgString += "\n"
-	msgString += "Confirm the registration by following this link:\n"
-	msgString += link + "\n"
-	msgString += "\n"
-	msgString += "Thank you.\n"
-	msgString += "\n"
-	msgString += "Best regards,\n"
-	msgString += "    The " + domain + " registration system\n"
-	msg := []byte(msgString)
-	from := "noreply@" + domain
-	to := []string{email}
-	hostPort := host + ":25"
-	return smtp.SendMail(hostPort, auth, from, to, msg)
+	return defaultEmailSettings.ConfirmationEmail(domain, link, username, email)
+}
+
+func ResetPasswordEmail(domain, link, username, email string) error {
+	return defaultEmailSettings.ResetPasswordEmail(domain, link, username, email)
 }
+
+func ForgotUsernameEmail(domain string, usernames []string, email string) error {
+	return defaultEmailSettings.ForgotUsernameEmail(domain, usernames, email)
+}
+
+// Templates for the text part of the emails.
+// Triple mustaches are used, since the text should not be HTML escaped.
+
+const confirmationText_tmpl = `Hi and welcome to {{{title}}}!
+
+Confirm the registration by following this link:
+{{{link}}}
+
+Thank you.
+
+Best regards,
+    The {{{title}}} registration system
+`
+
+const resetPasswordText_tmpl = `Hi {{{username}}},
+
+Someone, hopefully you, asked for a new password for {{{title}}}.
+
+Choose a new password by following this link:
+{{{link}}}
+
+The link can only be used once, and will expire soon.
+If you have not asked for this, just ignore this email. Your password will not be changed.
+
+Best regards,
+    The {{{title}}} registration system
+`
+
+const forgotUsernameText_tmpl = `Hi,
+
+Someone, hopefully you, asked which username belongs to this email address at {{{title}}}.
+
+{{#several}}The usernames are:{{/several}}{{^several}}The username is:{{/several}}
+{{#usernames}}    {{{.}}}
+{{/usernames}}
+If you have not asked for this, just ignore this email.
+
+Best regards,
+    The {{{title}}} registration system
+`
+
+// Templates for the HTML part of the emails, placed within the layout
+
+const confirmationHTML_tmpl = `<p>Hi and welcome to {{title}}!</p>
+<p>Confirm the registration by following this link:</p>
+<p><a href="{{link}}" style="color: {{Nicecolor}};">{{link}}</a></p>
+<p>Thank you.</p>`
+
+const resetPasswordHTML_tmpl = `<p>Hi {{username}},</p>
+<p>Someone, hopefully you, asked for a new password for {{title}}.</p>
+<p>Choose a new password by following this link:</p>
+<p><a href="{{link}}" style="color: {{Nicecolor}};">{{link}}</a></p>
+<p>The link can only be used once, and will expire soon.</p>
+<p>If you have not asked for this, just ignore this email. Your password will not be changed.</p>`
+
+const forgotUsernameHTML_tmpl = `<p>Hi,</p>
+<p>Someone, hopefully you, asked which username belongs to this email address at {{title}}.</p>
+<p>{{#several}}The usernames are:{{/several}}{{^several}}The username is:{{/several}}</p>
+<ul>{{#usernames}}<li><b>{{.}}</b></li>{{/usernames}}</ul>
+<p>If you have not asked for this, just ignore this email.</p>`
+
+// Layout for the HTML part of all emails, with the colors of the ColorScheme.
+// Email clients only reliably support inline styles.
+const emailLayout_tmpl = `<!doctype html>
+<html>
+<head><meta http-equiv="Content-Type" content="text/html; charset=UTF-8"><title>{{subject}}</title></head>
+<body style="margin: 0; padding: 0; background-color: {{Default_background}};">
+<table width="100%" cellpadding="0" cellspacing="0" style="background-color: {{Default_background}};">
+<tr><td align="center" style="padding: 2em 0;">
+<table width="600" cellpadding="0" cellspacing="0" style="font-family: Verdana, Geneva, sans-serif;">
+<tr><td style="background-color: {{Darkgray}}; padding: 1em 1.5em; font-size: 1.6em; font-weight: bold; color: {{Nicecolor}};">{{title}}</td></tr>
+<tr><td style="background-color: #ffffff; padding: 1.5em; color: black; font-size: 1em;">
+{{{content}}}
+<p>Best regards,<br>The {{title}} registration system</p>
+</td></tr>
+<tr><td style="background-color: {{Darkgray}}; padding: 0.5em 1.5em; font-size: 0.7em; text-align: right; color: {{Menu_link}};">{{footer}}</td></tr>
+</table>
+</td></tr>
+</table>
+</body>
+</html>
+`
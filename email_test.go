@@ -1,12 +1,77 @@
 package genericsite
 
 import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
 	"testing"
 )
 
 func Test1(t *testing.T) {
+	mm := NewMemoryMailer()
+	SetMailer(mm)
+	defer SetMailer(NewSMTPMailer("localhost", 25, "", ""))
+
 	err := ConfirmationEmail("origin_domain.com", "http://somewhe.re/", "username", "username@somewhe.re")
 	if err != nil {
-		t.Log("sending email failed")
+		t.Fatal("sending email failed: " + err.Error())
+	}
+	sent := mm.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("expected one email, got %d", len(sent))
+	}
+	if sent[0].From != "noreply@origin_domain.com" || sent[0].To[0] != "username@somewhe.re" {
+		t.Error("wrong sender or recipient")
+	}
+	if !strings.Contains(string(sent[0].Msg), "http://somewhe.re/") {
+		t.Error("the confirmation link is missing")
+	}
+}
+
+func TestMultipartEmail(t *testing.T) {
+	cp := DefaultCP(nil)
+	cp.Title = "Example Site"
+	cp.ColorScheme.Nicecolor = "#123456"
+	es := NewEmailSettings(cp)
+
+	_, _, msg, err := es.Compose("forgotusername", "example.com", "someone@example.com", map[string]interface{}{"usernames": []string{"alice", "bob"}, "several": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"Date", "Message-Id", "Mime-Version", "From", "To", "Subject"} {
+		if m.Header.Get(key) == "" {
+			t.Error("missing header: " + key)
+		}
+	}
+	if m.Header.Get("Subject") != "Your username at Example Site" {
+		t.Error("wrong subject: " + m.Header.Get("Subject"))
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatal("expected a multipart/alternative email")
+	}
+	parts := make(map[string]string)
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		data, _ := ioutil.ReadAll(p) // quoted-printable is decoded by the reader
+		contentType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		parts[contentType] = string(data)
+	}
+	if !strings.Contains(parts["text/plain"], "The usernames are:") || !strings.Contains(parts["text/plain"], "    bob") {
+		t.Error("unexpected text part: " + parts["text/plain"])
+	}
+	if !strings.Contains(parts["text/html"], "<li><b>alice</b></li>") || !strings.Contains(parts["text/html"], "#123456") {
+		t.Error("the HTML part is not styled after the site: " + parts["text/html"])
 	}
 }
@@ -0,0 +1,271 @@
+package genericsite
+
+// RSS 2.0 and Atom 1.0 feeds for content pages
+
+import (
+	"encoding/xml"
+	"html"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/xyproto/onthefly"
+)
+
+const (
+	atomNamespace   = "http://www.w3.org/2005/Atom"
+	dcNamespace     = "http://purl.org/dc/elements/1.1/"
+	rssContentType  = "application/rss+xml"
+	atomContentType = "application/atom+xml"
+
+	// Characters of the text that are used when a page has no Summary
+	summaryLength = 200
+)
+
+type (
+	// A feed of content pages, newest first
+	Feed struct {
+		Title       string
+		Description string
+		Author      string                     // used for pages without an Author
+		MaxItems    int                        // 0 means no limit
+		Filter      func(cp *ContentPage) bool // only pages where Filter returns true are included, if set
+
+		// Pages with RequiresLogin are left out, since the feeds are public and have the whole content
+		IncludeLoginPages bool
+
+		pages PageCollection
+	}
+
+	xmlAtomLink struct {
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr,omitempty"`
+		Type string `xml:"type,attr,omitempty"`
+	}
+
+	xmlRSSItem struct {
+		Title       string `xml:"title"`
+		Link        string `xml:"link"`
+		GUID        string `xml:"guid"`
+		PubDate     string `xml:"pubDate,omitempty"`
+		Creator     string `xml:"dc:creator,omitempty"`
+		Description string `xml:"description,omitempty"`
+	}
+
+	xmlRSS struct {
+		XMLName       xml.Name     `xml:"rss"`
+		Version       string       `xml:"version,attr"`
+		XmlnsAtom     string       `xml:"xmlns:atom,attr"`
+		XmlnsDC       string       `xml:"xmlns:dc,attr"`
+		Title         string       `xml:"channel>title"`
+		Link          string       `xml:"channel>link"`
+		Description   string       `xml:"channel>description"`
+		Self          xmlAtomLink  `xml:"channel>atom:link"`
+		LastBuildDate string       `xml:"channel>lastBuildDate,omitempty"`
+		Items         []xmlRSSItem `xml:"channel>item"`
+	}
+
+	xmlAtomText struct {
+		Type string `xml:"type,attr,omitempty"`
+		Body string `xml:",chardata"`
+	}
+
+	xmlAtomEntry struct {
+		Title     string       `xml:"title"`
+		Link      xmlAtomLink  `xml:"link"`
+		ID        string       `xml:"id"`
+		Published string       `xml:"published,omitempty"`
+		Updated   string       `xml:"updated"`
+		Author    string       `xml:"author>name,omitempty"`
+		Summary   string       `xml:"summary,omitempty"`
+		Content   *xmlAtomText `xml:"content,omitempty"`
+	}
+
+	xmlAtom struct {
+		XMLName xml.Name       `xml:"feed"`
+		Xmlns   string         `xml:"xmlns,attr"`
+		Title   string         `xml:"title"`
+		Link    []xmlAtomLink  `xml:"link"`
+		ID      string         `xml:"id"`
+		Updated string         `xml:"updated"`
+		Author  string         `xml:"author>name"`
+		Entries []xmlAtomEntry `xml:"entry"`
+	}
+)
+
+// Create a feed of the given content pages. Only pages with a Published or LastModified time,
+// and that do not require login, are included.
+func NewFeed(title, description string, pc PageCollection) *Feed {
+	return &Feed{Title: title, Description: description, Author: title, pages: pc}
+}
+
+// When the page was published, or else when it was last modified
+func published(cp *ContentPage) time.Time {
+	if cp.Published.IsZero() {
+		return cp.LastModified
+	}
+	return cp.Published
+}
+
+// When the page was last modified, or else when it was published
+func updated(cp *ContentPage) time.Time {
+	if cp.LastModified.IsZero() {
+		return cp.Published
+	}
+	return cp.LastModified
+}
+
+// The pages in the feed, newest first
+func (f *Feed) Items() []*ContentPage {
+	var items []*ContentPage
+	for i := range f.pages {
+		cp := &f.pages[i]
+		if published(cp).IsZero() || (cp.RequiresLogin && !f.IncludeLoginPages) || (f.Filter != nil && !f.Filter(cp)) {
+			continue
+		}
+		items = append(items, cp)
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return published(items[i]).After(published(items[j]))
+	})
+	if f.MaxItems > 0 && len(items) > f.MaxItems {
+		items = items[:f.MaxItems]
+	}
+	return items
+}
+
+// The summary of the page, or the start of the text if there is no summary
+func summary(cp *ContentPage) string {
+	if cp.Summary != "" {
+		return cp.Summary
+	}
+	runes := []rune(StripTags(cp.ContentHTML))
+	if len(runes) <= summaryLength {
+		return string(runes)
+	}
+	return string(runes[:summaryLength]) + "…"
+}
+
+// The time of the most recently updated page
+func lastUpdated(items []*ContentPage) time.Time {
+	var t time.Time
+	for _, cp := range items {
+		if updated(cp).After(t) {
+			t = updated(cp)
+		}
+	}
+	return t
+}
+
+func (f *Feed) author(cp *ContentPage) string {
+	if cp.Author != "" {
+		return cp.Author
+	}
+	return f.Author
+}
+
+// Generate an RSS 2.0 document, given the base URL of the site and the path of the feed
+func (f *Feed) RSS(baseURL, feedURL string) ([]byte, error) {
+	items := f.Items()
+	rss := xmlRSS{
+		Version:     "2.0",
+		XmlnsAtom:   atomNamespace,
+		XmlnsDC:     dcNamespace,
+		Title:       f.Title,
+		Link:        baseURL + "/",
+		Description: f.Description,
+		Self:        xmlAtomLink{absoluteURL(baseURL, feedURL), "self", rssContentType},
+	}
+	if t := lastUpdated(items); !t.IsZero() {
+		rss.LastBuildDate = t.Format(time.RFC1123Z)
+	}
+	for _, cp := range items {
+		link := absoluteURL(baseURL, cp.Url)
+		rss.Items = append(rss.Items, xmlRSSItem{
+			Title:       cp.ContentTitle,
+			Link:        link,
+			GUID:        link,
+			PubDate:     published(cp).Format(time.RFC1123Z),
+			Creator:     f.author(cp),
+			Description: summary(cp),
+		})
+	}
+	return marshalXML(rss)
+}
+
+// Generate an Atom 1.0 document, given the base URL of the site and the path of the feed
+func (f *Feed) Atom(baseURL, feedURL string) ([]byte, error) {
+	items := f.Items()
+	self := absoluteURL(baseURL, feedURL)
+	atom := xmlAtom{
+		Xmlns:   atomNamespace,
+		Title:   f.Title,
+		Link:    []xmlAtomLink{{Href: self, Rel: "self", Type: atomContentType}, {Href: baseURL + "/"}},
+		ID:      self,
+		Updated: w3cTime(lastUpdated(items)),
+		Author:  f.Author,
+	}
+	if atom.Updated == "" {
+		atom.Updated = w3cTime(time.Unix(0, 0))
+	}
+	for _, cp := range items {
+		link := absoluteURL(baseURL, cp.Url)
+		entry := xmlAtomEntry{
+			Title:   cp.ContentTitle,
+			Link:    xmlAtomLink{Href: link},
+			ID:      link,
+			Updated: w3cTime(updated(cp)),
+			Summary: summary(cp),
+			Content: &xmlAtomText{"html", cp.ContentHTML},
+		}
+		if !cp.Published.IsZero() {
+			entry.Published = w3cTime(cp.Published)
+		}
+		if cp.Author != "" {
+			entry.Author = cp.Author
+		}
+		atom.Entries = append(atom.Entries, entry)
+	}
+	return marshalXML(atom)
+}
+
+// Serve the feed as RSS and Atom at the given URLs. An empty URL is not served.
+// The links start with the site URL from SetSiteURL, and only with the Host of the request if it is not set.
+func (f *Feed) ServePages(r *mux.Router, rssURL, atomURL string) {
+	serve := func(url, contentType string, generate func(string, string) ([]byte, error)) {
+		if url == "" {
+			return
+		}
+		r.HandleFunc(url, func(w http.ResponseWriter, req *http.Request) {
+			data, err := generate(BaseURL(req), url)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			serveGenerated(w, req, data, contentType+"; charset=utf-8", documentCacheControl, time.Time{})
+		})
+	}
+	serve(rssURL, rssContentType, f.RSS)
+	serve(atomURL, atomContentType, f.Atom)
+}
+
+// Add <link> tags to the head of the page, so that browsers and feed readers can find the feeds.
+// An empty URL is not linked to.
+func AddFeedLinks(page *onthefly.Page, title, rssURL, atomURL string) error {
+	head, err := page.GetTag("head")
+	if err != nil {
+		return err
+	}
+	for _, feed := range []struct{ url, contentType string }{{rssURL, rssContentType}, {atomURL, atomContentType}} {
+		if feed.url == "" {
+			continue
+		}
+		link := head.AddNewTag("link")
+		link.AddAttrib("rel", "alternate")
+		link.AddAttrib("type", feed.contentType)
+		link.AddAttrib("title", html.EscapeString(title))
+		link.AddAttrib("href", html.EscapeString(feed.url))
+	}
+	return nil
+}
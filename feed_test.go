@@ -0,0 +1,128 @@
+package genericsite
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func testFeed() *Feed {
+	day := func(d int) time.Time { return time.Date(2020, 1, d, 0, 0, 0, 0, time.UTC) }
+	pc := PageCollection{
+		{Url: "/old", ContentTitle: "Old", ContentHTML: "<p>Old &amp; dusty</p>", Published: day(1)},
+		{Url: "/new", ContentTitle: "New", ContentHTML: "<p>Fresh</p>", Published: day(3), LastModified: day(4), Author: "Alice", Summary: "Brand new"},
+		{Url: "/draft", ContentTitle: "Draft", Published: day(2)},
+		{Url: "/undated", ContentTitle: "Undated"},
+	}
+	feed := NewFeed("Test", "A test site", pc)
+	feed.Filter = func(cp *ContentPage) bool { return cp.Url != "/draft" }
+	return feed
+}
+
+func TestRSS(t *testing.T) {
+	r := mux.NewRouter()
+	testFeed().ServePages(r, "/feed.rss", "")
+	rec := do(r, "GET", "/feed.rss", nil)
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "application/rss+xml") {
+		t.Error("wrong content type: " + rec.Header().Get("Content-Type"))
+	}
+	var rss struct {
+		Items []struct {
+			Title       string `xml:"title"`
+			Link        string `xml:"link"`
+			PubDate     string `xml:"pubDate"`
+			Creator     string `xml:"http://purl.org/dc/elements/1.1/ creator"`
+			Description string `xml:"description"`
+		} `xml:"channel>item"`
+	}
+	if err := xml.Unmarshal(rec.Body.Bytes(), &rss); err != nil {
+		t.Fatal(err)
+	}
+	if len(rss.Items) != 2 || rss.Items[0].Title != "New" || rss.Items[1].Title != "Old" {
+		t.Fatalf("expected the dated, unfiltered pages, newest first: %+v", rss.Items)
+	}
+	if rss.Items[0].Link != "http://example.com/new" || rss.Items[0].PubDate != "Fri, 03 Jan 2020 00:00:00 +0000" || rss.Items[0].Creator != "Alice" {
+		t.Errorf("unexpected item: %+v", rss.Items[0])
+	}
+	if rss.Items[1].Description != "Old & dusty" || rss.Items[1].Creator != "Test" {
+		t.Errorf("expected a summary from the content and the default author: %+v", rss.Items[1])
+	}
+	if do(r, "GET", "/feed.atom", nil).Code != 404 {
+		t.Error("the atom feed should not be served")
+	}
+}
+
+func TestAtom(t *testing.T) {
+	data, err := testFeed().Atom("http://example.com", "/feed.atom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var atom struct {
+		XMLName xml.Name `xml:"http://www.w3.org/2005/Atom feed"`
+		ID      string   `xml:"id"`
+		Updated string   `xml:"updated"`
+		Entries []struct {
+			ID        string `xml:"id"`
+			Published string `xml:"published"`
+			Updated   string `xml:"updated"`
+			Content   string `xml:"content"`
+		} `xml:"entry"`
+	}
+	if err := xml.Unmarshal(data, &atom); err != nil {
+		t.Fatal(err)
+	}
+	if atom.ID != "http://example.com/feed.atom" || atom.Updated != "2020-01-04T00:00:00Z" || len(atom.Entries) != 2 {
+		t.Fatalf("unexpected feed:\n%s", data)
+	}
+	if e := atom.Entries[0]; e.Published != "2020-01-03T00:00:00Z" || e.Updated != "2020-01-04T00:00:00Z" || e.Content != "<p>Fresh</p>" {
+		t.Errorf("unexpected entry: %+v", e)
+	}
+}
+
+func TestFeedLinks(t *testing.T) {
+	cp := DefaultCP(nil)
+	cp.RSSURL = "/feed.rss"
+	page := genericPageBuilder(cp)
+	html := page.String()
+	if !strings.Contains(html, "href=\"/feed.rss\"") || !strings.Contains(html, "type=\"application/rss+xml\"") {
+		t.Error("expected a link to the RSS feed")
+	}
+	if strings.Contains(html, "application/atom+xml") {
+		t.Error("there should be no link to an atom feed")
+	}
+}
+
+func TestFeedLoginPages(t *testing.T) {
+	pc := PageCollection{
+		{Url: "/public", ContentTitle: "Public", ContentHTML: "<p>For everyone</p>", Published: time.Now()},
+		{Url: "/members", ContentTitle: "Members", ContentHTML: "<p>Secret</p>", Published: time.Now(), RequiresLogin: true},
+	}
+	feed := NewFeed("Test", "A test site", pc)
+	data, err := feed.Atom("http://example.com", "/feed.atom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items := feed.Items(); len(items) != 1 || items[0].Url != "/public" || strings.Contains(string(data), "Secret") {
+		t.Error("pages that require login should not be in the feeds: " + string(data))
+	}
+	feed.IncludeLoginPages = true
+	if len(feed.Items()) != 2 {
+		t.Error("expected the pages that require login to be included when asked for")
+	}
+}
+
+func TestFeedSiteURL(t *testing.T) {
+	r := mux.NewRouter()
+	testFeed().ServePages(r, "/feed.rss", "/feed.atom")
+	SetSiteURL("https://example.org")
+	defer SetSiteURL("")
+	for _, url := range []string{"/feed.rss", "/feed.atom"} {
+		body := do(r, "GET", "http://attacker.example"+url, nil).Body.String()
+		if !strings.Contains(body, "https://example.org/new") || strings.Contains(body, "attacker.example") {
+			t.Errorf("expected the site URL in %s:\n%s", url, body)
+		}
+	}
+}
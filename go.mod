@@ -3,6 +3,7 @@ module github.com/xyproto/genericsite
 go 1.10
 
 require (
+	github.com/BurntSushi/toml v0.3.0
 	github.com/drbawb/mustache v0.0.0-20130930130810-b035beeed55a
 	github.com/gorilla/mux v1.7.3
 	github.com/xyproto/onthefly v0.0.0-20191101100742-c576f31faceb
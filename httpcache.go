@@ -0,0 +1,145 @@
+package genericsite
+
+// Caching headers and conditional requests for generated content
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Generated HTML depends on who is logged in, so it must be checked every time
+	htmlCacheControl = "private, no-cache"
+
+	// Content at a URL that is not a hash of the contents may change when the server restarts
+	shortCacheControl = "public, max-age=3600"
+
+	// Generated documents, like sitemaps and feeds, change when pages are added
+	documentCacheControl = "public, no-cache"
+
+	htmlContentType = "text/html; charset=utf-8"
+	cssContentType  = "text/css; charset=utf-8"
+)
+
+// A strong ETag for the given data
+func contentETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "\"" + hex.EncodeToString(sum[:16]) + "\""
+}
+
+// Check if the ETag matches one in an If-None-Match header.
+// Weak comparison is used, as it should be for If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the client already has the current version.
+// If-Modified-Since is only used when there is no If-None-Match, as described in RFC 7232.
+func notModified(req *http.Request, etag string, modified time.Time) bool {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, etag)
+	}
+	if ims := req.Header.Get("If-Modified-Since"); ims != "" && !modified.IsZero() {
+		t, err := http.ParseTime(ims)
+		// The header only has a precision of one second
+		return err == nil && !modified.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// Serve content with the given ETag, Last-Modified time and Cache-Control policy,
+// or 304 Not Modified if the client already has it. A zero modification time is not sent.
+// The content is compressed if the client accepts it.
+func serveWithETag(w http.ResponseWriter, req *http.Request, data []byte, etag, contentType, cacheControl string, modified time.Time) {
+	serveVariants(w, req, &variants{data: data, etag: etag}, contentType, cacheControl, modified)
+}
+
+// Records the status code instead of writing it, so that headers can be set after the handler has chosen a status
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+}
+
+// Serve content, or one of its compressed variants, like serveWithETag
+func serveVariants(w http.ResponseWriter, req *http.Request, v *variants, contentType, cacheControl string, modified time.Time) {
+	serveVariantsWithStatus(w, req, http.StatusOK, v, contentType, cacheControl, modified)
+}
+
+// Serve content with the given status code. Only 200 OK can become 304 Not Modified.
+func serveVariantsWithStatus(w http.ResponseWriter, req *http.Request, status int, v *variants, contentType, cacheControl string, modified time.Time) {
+	encoding := v.encoding(req)
+	etag := encodedETag(v.etag, encoding)
+	header := w.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Cache-Control", cacheControl)
+	header.Set("ETag", etag)
+	header.Add("Vary", "Accept-Encoding")
+	if !modified.IsZero() {
+		header.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if status == http.StatusOK && notModified(req, etag, modified) {
+		// Content-Type is not sent with 304
+		header.Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	body := v.body(encoding)
+	if encoding != "" {
+		header.Set("Content-Encoding", encoding)
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	if req.Method == "HEAD" {
+		return
+	}
+	w.Write(body)
+}
+
+// Serve generated content with an ETag that is the hash of the contents
+func serveGenerated(w http.ResponseWriter, req *http.Request, data []byte, contentType, cacheControl string, modified time.Time) {
+	serveWithETag(w, req, data, contentETag(data), contentType, cacheControl, modified)
+}
+
+// Serve a generated page, with the time it took to serve it filled in.
+// The ETag does not depend on the time, so that it stays the same for the same page.
+// There is no Last-Modified, since the page is rendered differently for each user,
+// and only the ETag changes when the rendered page changes.
+func serveHTML(w http.ResponseWriter, req *http.Request, status int, rt *RequestTiming, html string) {
+	etag := contentETag([]byte(html))
+	data := []byte(rt.finish(w, html))
+	serveVariantsWithStatus(w, req, status, &variants{data: data, etag: etag}, htmlContentType, htmlCacheControl, time.Time{})
+}
+
+// The status code the handler chose, or 200 OK
+func (sr *statusRecorder) statusOrOK() int {
+	if sr.status == 0 {
+		return http.StatusOK
+	}
+	return sr.status
+}
+
+// Serve CSS that is generated once, and compressed once
+func serveCSS(css string, modified time.Time) func(http.ResponseWriter, *http.Request) {
+	data := []byte(css)
+	v := precompressed(data, contentETag(data))
+	return func(w http.ResponseWriter, req *http.Request) {
+		serveVariants(w, req, v, cssContentType, shortCacheControl, modified)
+	}
+}
@@ -0,0 +1,87 @@
+package genericsite
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Send a GET request with the given headers
+func get(r *mux.Router, target string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", target, nil)
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestConditionalGet(t *testing.T) {
+	modified := time.Date(2020, 5, 17, 12, 0, 0, 0, time.UTC)
+	cp := DefaultCP(nil)
+	cp.Url = "/page"
+	cp.LastModified = modified
+	r := mux.NewRouter()
+	cp.Pub(r, newMemUserState(), cp.Url, "/css/menu.css", cp.ColorScheme, testTVGF()(newMemUserState()))
+
+	for _, url := range []string{"/page", "/css/style.css", "/css/menu.css"} {
+		w := get(r, url, nil)
+		etag := w.Header().Get("ETag")
+		if w.Code != 200 || etag == "" || w.Header().Get("Cache-Control") == "" {
+			t.Fatalf("expected an ETag and Cache-Control for %s", url)
+		}
+		if w = get(r, url, map[string]string{"If-None-Match": "\"other\", " + etag}); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("expected 304 for %s, got %d", url, w.Code)
+		}
+		if w = get(r, url, map[string]string{"If-None-Match": "\"other\""}); w.Code != 200 {
+			t.Errorf("expected 200 for a different ETag for %s, got %d", url, w.Code)
+		}
+	}
+
+	// The rendered HTML depends on the user, so only the ETag is used for it
+	w := get(r, "/page", nil)
+	if w.Header().Get("Last-Modified") != "" || w.Header().Get("Cache-Control") != htmlCacheControl {
+		t.Error("expected no modification time for the page, and the HTML cache policy")
+	}
+	if w = get(r, "/page", map[string]string{"If-Modified-Since": "Sun, 17 May 2020 12:00:00 GMT"}); w.Code != 200 {
+		t.Error("expected 200 for a page that is only checked by the time")
+	}
+
+	w = get(r, "/css/style.css", nil)
+	if w.Header().Get("Last-Modified") != "Sun, 17 May 2020 12:00:00 GMT" {
+		t.Error("expected the modification time of the page for the CSS")
+	}
+	if w = get(r, "/css/style.css", map[string]string{"If-Modified-Since": "Sun, 17 May 2020 12:00:00 GMT"}); w.Code != http.StatusNotModified {
+		t.Error("expected 304 for CSS that has not been modified since")
+	}
+	if w = get(r, "/css/style.css", map[string]string{"If-Modified-Since": "Sat, 16 May 2020 12:00:00 GMT"}); w.Code != 200 {
+		t.Error("expected 200 for CSS that has been modified since")
+	}
+	if w = get(r, "/css/style.css", map[string]string{"If-Modified-Since": "Sun, 17 May 2020 12:00:00 GMT", "If-None-Match": "\"other\""}); w.Code != 200 {
+		t.Error("If-None-Match should take precedence over If-Modified-Since")
+	}
+}
+
+func TestNoLastModifiedAfterLogin(t *testing.T) {
+	state := newMemUserState()
+	state.AddUser("bob", "hunter2", "bob@example.com")
+	cp := DefaultCP(nil)
+	cp.Url = "/page"
+	r := mux.NewRouter()
+	cp.Pub(r, state, cp.Url, "/css/menu.css", cp.ColorScheme, testTVGF()(state))
+
+	w := get(r, "/page", nil)
+	state.SetLoggedIn("bob")
+	req := httptest.NewRequest("GET", "/page", nil)
+	req.Header.Set("If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	req.AddCookie(&http.Cookie{Name: "user", Value: "bob"})
+	after := httptest.NewRecorder()
+	r.ServeHTTP(after, req)
+	if after.Code != 200 || after.Header().Get("ETag") == w.Header().Get("ETag") {
+		t.Error("expected the page to be sent again after logging in")
+	}
+}
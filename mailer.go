@@ -0,0 +1,204 @@
+package genericsite
+
+// Different ways of sending email
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A Mailer can deliver a complete email message (headers and body) to the given recipients
+type Mailer interface {
+	Send(from string, to []string, msg []byte) error
+}
+
+var (
+	// The Mailer that is used for sending all emails
+	mailer    Mailer = NewSMTPMailer("localhost", 25, "", "")
+	mailerMut sync.RWMutex
+)
+
+// Set the Mailer that is used for sending all emails
+func SetMailer(m Mailer) {
+	mailerMut.Lock()
+	mailer = m
+	mailerMut.Unlock()
+}
+
+// Get the Mailer that is used for sending all emails
+func CurrentMailer() Mailer {
+	mailerMut.RLock()
+	defer mailerMut.RUnlock()
+	return mailer
+}
+
+// Send email through an SMTP server
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string // no authentication if empty
+	Password string
+	StartTLS bool // refuse to send if the server does not support STARTTLS
+}
+
+// Create a Mailer for the given SMTP server. STARTTLS is used if the server supports it.
+func NewSMTPMailer(host string, port int, username, password string) *SMTPMailer {
+	return &SMTPMailer{host, port, username, password, false}
+}
+
+func (m *SMTPMailer) Send(from string, to []string, msg []byte) error {
+	c, err := smtp.Dial(net.JoinHostPort(m.Host, strconv.Itoa(m.Port)))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: m.Host}); err != nil {
+			return err
+		}
+	} else if m.StartTLS {
+		return errors.New(m.Host + " does not support STARTTLS")
+	}
+
+	if m.Username != "" {
+		// PlainAuth refuses to send the password unencrypted, except to localhost
+		if err := c.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, recipient := range to {
+		if err := c.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Send email by piping it to a sendmail compatible executable
+type SendmailMailer struct {
+	Path string // for instance /usr/sbin/sendmail
+}
+
+// Create a Mailer that uses the given sendmail executable
+func NewSendmailMailer(path string) *SendmailMailer {
+	return &SendmailMailer{path}
+}
+
+func (m *SendmailMailer) Send(from string, to []string, msg []byte) error {
+	args := append([]string{"-i", "-f", from, "--"}, to...)
+	cmd := exec.Command(m.Path, args...)
+	cmd.Stdin = bytes.NewReader(msg)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.New(m.Path + ": " + err.Error() + ": " + string(bytes.TrimSpace(output)))
+	}
+	return nil
+}
+
+// Store email as files in a Maildir, instead of sending it.
+// Useful for development, or for handing the mail over to another program.
+type MaildirMailer struct {
+	Dir string
+
+	mut     sync.Mutex
+	counter int
+}
+
+// Create a Mailer that stores all email in the given Maildir.
+// The tmp, new and cur directories are created if needed.
+func NewMaildirMailer(dir string) (*MaildirMailer, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &MaildirMailer{Dir: dir}, nil
+}
+
+// Generate a unique filename, as described in https://cr.yp.to/proto/maildir.html
+func (m *MaildirMailer) uniqueName() string {
+	m.mut.Lock()
+	m.counter++
+	counter := m.counter
+	m.mut.Unlock()
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	now := time.Now()
+	return strconv.FormatInt(now.Unix(), 10) + ".M" + strconv.Itoa(now.Nanosecond()/1000) + "P" + strconv.Itoa(os.Getpid()) + "Q" + strconv.Itoa(counter) + "." + hostname
+}
+
+// Write the message to tmp/ and then move it to new/, so that readers never see half a message
+func (m *MaildirMailer) Send(from string, to []string, msg []byte) error {
+	name := m.uniqueName()
+	tmpName := filepath.Join(m.Dir, "tmp", name)
+	if err := ioutil.WriteFile(tmpName, msg, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, filepath.Join(m.Dir, "new", name))
+}
+
+// An email that has been sent with a MemoryMailer
+type SentEmail struct {
+	From string
+	To   []string
+	Msg  []byte
+}
+
+// Keep all email in memory, instead of sending it. Useful for testing.
+type MemoryMailer struct {
+	mut  sync.Mutex
+	sent []SentEmail
+}
+
+// Create a Mailer that keeps all email in memory
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+func (m *MemoryMailer) Send(from string, to []string, msg []byte) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.sent = append(m.sent, SentEmail{from, append([]string{}, to...), append([]byte{}, msg...)})
+	return nil
+}
+
+// All email that has been sent so far
+func (m *MemoryMailer) Sent() []SentEmail {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return append([]SentEmail{}, m.sent...)
+}
+
+// Forget all email that has been sent
+func (m *MemoryMailer) Clear() {
+	m.mut.Lock()
+	m.sent = nil
+	m.mut.Unlock()
+}
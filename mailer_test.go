@@ -0,0 +1,37 @@
+package genericsite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMaildirMailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := NewMaildirMailer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := m.Send("a@example.com", []string{"b@example.com"}, []byte("Subject: hi\r\n\r\nhello\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "new", "*"))
+	if len(files) != 2 {
+		t.Fatalf("expected 2 messages in new/, got %d", len(files))
+	}
+	data, _ := ioutil.ReadFile(files[0])
+	if string(data) != "Subject: hi\r\n\r\nhello\r\n" {
+		t.Error("the stored message differs from the sent message")
+	}
+	if tmpFiles, _ := filepath.Glob(filepath.Join(dir, "tmp", "*")); len(tmpFiles) != 0 {
+		t.Error("messages were left in tmp/")
+	}
+}
@@ -0,0 +1,434 @@
+package genericsite
+
+// Persistent queue for outgoing email, with retries
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"html"
+	"log"
+	"mime"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/xyproto/pinterface"
+	"github.com/xyproto/webhandle"
+)
+
+const (
+	defaultMaxAttempts  = 8
+	defaultInitialDelay = 30 * time.Second
+	defaultMaxDelay     = 2 * time.Hour
+	defaultPollInterval = 10 * time.Second
+
+	// Field names in the hash maps, where the owner is the ID of the email
+	queuedEmailField = "email"
+	claimField       = "claim"
+
+	// How long an email is claimed by the process that is sending it.
+	// If the process stops while sending, another one can try after this time.
+	claimTimeout = 10 * time.Minute
+)
+
+// An email that is waiting to be sent, or that could not be sent
+type QueuedEmail struct {
+	ID        string
+	From      string
+	To        []string
+	Msg       []byte
+	Queued    time.Time
+	Attempts  int
+	NextTry   time.Time
+	LastError string
+}
+
+// A Mailer that stores all email in the database and sends it in the background,
+// with exponential backoff. Email that can not be sent after MaxAttempts is moved to the failed email.
+// Every email is stored under its own key, so that the queue survives restarts and
+// several processes can share it without overwriting what the others have queued.
+// Hash maps are used instead of lists, since single emails must be claimed, updated and removed.
+// Use SetMailer to send all email through the queue.
+type MailQueue struct {
+	MaxAttempts  int
+	InitialDelay time.Duration // the delay after the first failed attempt, doubled for every attempt
+	MaxDelay     time.Duration
+
+	mailer  Mailer // for the actual sending
+	pending pinterface.IHashMap
+	failed  pinterface.IHashMap
+	claims  pinterface.IKeyValue // counters, only the one that counts to 1 may send an email
+	worker  string               // identifies this queue when claiming email
+
+	processing sync.Mutex // only one Process at the time in this process
+	mut        sync.Mutex // for running
+	wake       chan bool
+	stop       chan bool
+	running    bool
+}
+
+// Create a new queue that keeps the email in hash maps created with the given ICreator,
+// and sends it with the given Mailer
+func NewMailQueue(creator pinterface.ICreator, m Mailer) (*MailQueue, error) {
+	pending, err := creator.NewHashMap("mailqueue_pending_emails")
+	if err != nil {
+		return nil, err
+	}
+	failed, err := creator.NewHashMap("mailqueue_failed_emails")
+	if err != nil {
+		return nil, err
+	}
+	claims, err := creator.NewKeyValue("mailqueue_claims")
+	if err != nil {
+		return nil, err
+	}
+	worker, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	return &MailQueue{
+		MaxAttempts:  defaultMaxAttempts,
+		InitialDelay: defaultInitialDelay,
+		MaxDelay:     defaultMaxDelay,
+		mailer:       m,
+		pending:      pending,
+		failed:       failed,
+		claims:       claims,
+		worker:       worker,
+		wake:         make(chan bool, 1),
+		stop:         make(chan bool),
+	}, nil
+}
+
+// Add an email to the queue. Only returns an error if the email could not be stored.
+func (mq *MailQueue) Send(from string, to []string, msg []byte) error {
+	id, err := randomToken()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := storeEmail(mq.pending, &QueuedEmail{ID: id, From: from, To: to, Msg: msg, Queued: now, NextTry: now}); err != nil {
+		return err
+	}
+	// Try to send it right away, if the worker is running
+	select {
+	case mq.wake <- true:
+	default:
+	}
+	return nil
+}
+
+// Start sending email in the background
+func (mq *MailQueue) Start() {
+	mq.mut.Lock()
+	defer mq.mut.Unlock()
+	if mq.running {
+		return
+	}
+	mq.running = true
+	go mq.work()
+}
+
+// Stop sending email in the background. The queue is kept.
+func (mq *MailQueue) Stop() {
+	mq.mut.Lock()
+	running := mq.running
+	mq.running = false
+	mq.mut.Unlock()
+	// The worker may be waiting for the lock, so the lock can not be held here
+	if running {
+		mq.stop <- true
+	}
+}
+
+func (mq *MailQueue) work() {
+	ticker := time.NewTicker(defaultPollInterval)
+	defer ticker.Stop()
+	for {
+		mq.Process(time.Now())
+		select {
+		case <-mq.stop:
+			return
+		case <-mq.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Store an email under its ID. A single value is set, so the email is either stored or not.
+func storeEmail(emails pinterface.IHashMap, qe *QueuedEmail) error {
+	data, err := json.Marshal(qe)
+	if err != nil {
+		return err
+	}
+	return emails.Set(qe.ID, queuedEmailField, string(data))
+}
+
+// Load the email with the given ID
+func loadEmail(emails pinterface.IHashMap, id string) (*QueuedEmail, error) {
+	data, err := emails.Get(id, queuedEmailField)
+	if err != nil {
+		return nil, err
+	}
+	var qe QueuedEmail
+	if err := json.Unmarshal([]byte(data), &qe); err != nil {
+		return nil, err
+	}
+	return &qe, nil
+}
+
+// Load all email in the given hash map, oldest first
+func loadEmails(emails pinterface.IHashMap) ([]*QueuedEmail, error) {
+	ids, err := emails.All()
+	if err != nil {
+		return nil, err
+	}
+	all := make([]*QueuedEmail, 0, len(ids))
+	for _, id := range ids {
+		// May have been removed by another process in the meantime
+		if qe, err := loadEmail(emails, id); err == nil {
+			all = append(all, qe)
+		}
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Queued.Before(all[j].Queued)
+	})
+	return all, nil
+}
+
+// Claim a pending email for sending, so that other processes that share the queue leave it alone.
+// The counter for the attempt, and for the expired claim that is taken over, if any, is increased
+// atomically, so only one process can win. Returns the email as it is stored now and the counter,
+// which must be removed with unclaim, or nil if another process has claimed or handled the email.
+func (mq *MailQueue) claim(qe *QueuedEmail, now time.Time) (*QueuedEmail, string) {
+	current, err := mq.pending.Get(qe.ID, claimField)
+	if err != nil {
+		current = ""
+	}
+	if fields := strings.Fields(current); len(fields) == 2 {
+		if expires, err := strconv.ParseInt(fields[1], 10, 64); err == nil && now.Unix() < expires {
+			return nil, ""
+		}
+	}
+	key := qe.ID + " " + strconv.Itoa(qe.Attempts) + " " + current
+	if count, err := mq.claims.Inc(key); err != nil || count != "1" {
+		return nil, ""
+	}
+	// The email may have been sent, or tried, by another process since it was loaded
+	stored, err := loadEmail(mq.pending, qe.ID)
+	if err != nil || stored.Attempts != qe.Attempts {
+		mq.unclaim(key)
+		return nil, ""
+	}
+	claim := mq.worker + " " + strconv.FormatInt(now.Add(claimTimeout).Unix(), 10)
+	if err := mq.pending.Set(qe.ID, claimField, claim); err != nil {
+		mq.unclaim(key)
+		return nil, ""
+	}
+	return stored, key
+}
+
+// Remove the counter for a claim, after the email has been updated or removed
+func (mq *MailQueue) unclaim(key string) {
+	if err := mq.claims.Del(key); err != nil {
+		log.Println("Could not remove the claim for a queued email: " + err.Error())
+	}
+}
+
+// The delay before the next attempt, after the given number of failed attempts
+func (mq *MailQueue) backoff(attempts int) time.Duration {
+	delay := mq.InitialDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= mq.MaxDelay {
+			return mq.MaxDelay
+		}
+	}
+	return delay
+}
+
+// Try to send all email that is due at the given time.
+// Every email is updated on its own, so that email can be queued in the meantime.
+// An email is only removed from the pending email after it has been sent or stored as failed.
+// Errors for a single email are logged, and the rest of the email is still processed.
+func (mq *MailQueue) Process(now time.Time) error {
+	mq.processing.Lock()
+	defer mq.processing.Unlock()
+
+	emails, err := loadEmails(mq.pending)
+	if err != nil {
+		return err
+	}
+	for _, qe := range emails {
+		if qe.NextTry.After(now) {
+			continue
+		}
+		qe, key := mq.claim(qe, now)
+		if qe == nil {
+			continue
+		}
+		if err := mq.send(qe, now); err != nil {
+			// The claim is kept until it expires, then the email is tried again
+			log.Println("Could not update the queued email " + qe.ID + ": " + err.Error())
+		}
+		mq.unclaim(key)
+	}
+	return nil
+}
+
+// Send a claimed email, and remove it, or store it for the next attempt or as failed
+func (mq *MailQueue) send(qe *QueuedEmail, now time.Time) error {
+	sendErr := mq.mailer.Send(qe.From, qe.To, qe.Msg)
+	if sendErr == nil {
+		return mq.pending.Del(qe.ID)
+	}
+	qe.Attempts++
+	qe.LastError = sendErr.Error()
+	qe.NextTry = now.Add(mq.backoff(qe.Attempts))
+	if qe.Attempts >= mq.MaxAttempts {
+		// Stored as failed before it is removed, so that it is not lost in between
+		if err := storeEmail(mq.failed, qe); err != nil {
+			return err
+		}
+		return mq.pending.Del(qe.ID)
+	}
+	if err := storeEmail(mq.pending, qe); err != nil {
+		return err
+	}
+	return mq.pending.DelKey(qe.ID, claimField)
+}
+
+// All email that is waiting to be sent
+func (mq *MailQueue) Pending() ([]*QueuedEmail, error) {
+	return loadEmails(mq.pending)
+}
+
+// All email that could not be sent
+func (mq *MailQueue) Failed() ([]*QueuedEmail, error) {
+	return loadEmails(mq.failed)
+}
+
+// Move an email from the failed email back to the queue
+func (mq *MailQueue) Retry(id string) error {
+	qe, err := loadEmail(mq.failed, id)
+	if err != nil {
+		return errors.New("no such email: " + id)
+	}
+	qe.Attempts = 0
+	qe.NextTry = time.Now()
+	// Queued before it is removed, so that it is not lost in between
+	if err := storeEmail(mq.pending, qe); err != nil {
+		return err
+	}
+	return mq.failed.Del(id)
+}
+
+// Remove all the failed email
+func (mq *MailQueue) ClearFailed() error {
+	return mq.failed.Clear()
+}
+
+// The subject of the email, for displaying
+func (qe *QueuedEmail) Subject() string {
+	m, err := mail.ReadMessage(bytes.NewReader(qe.Msg))
+	if err != nil {
+		return ""
+	}
+	dec := new(mime.WordDecoder)
+	subject, err := dec.DecodeHeader(m.Header.Get("Subject"))
+	if err != nil {
+		return m.Header.Get("Subject")
+	}
+	return subject
+}
+
+// Serve an overview of pending and failed email at /admin/mail, for administrators only
+func (mq *MailQueue) ServePages(r *mux.Router, basecp BaseCP, userState pinterface.IUserState, tvgf TemplateValueGeneratorFactory) {
+	cp := basecp(userState)
+	cp.ContentTitle = "Email queue"
+	cp.Url = "/admin/mail"
+	tvg := tvgf(userState)
+	r.HandleFunc("/admin/mail", cp.WrapSimpleContextHandle(r, mq.adminOverview(userState), tvg))
+}
+
+// Table of queued email. csrfField is the hidden field with the token of the administrator, for the retry buttons.
+func emailTable(emails []*QueuedEmail, retryButton bool, csrfField string) string {
+	if len(emails) == 0 {
+		return "<p>None.</p>"
+	}
+	var buf bytes.Buffer
+	buf.WriteString("<table class=\"mailqueue\"><tr><th>To</th><th>Subject</th><th>Queued</th><th>Attempts</th><th>Next try</th><th>Last error</th>")
+	if retryButton {
+		buf.WriteString("<th></th>")
+	}
+	buf.WriteString("</tr>")
+	for _, qe := range emails {
+		to := ""
+		if len(qe.To) > 0 {
+			to = qe.To[0]
+		}
+		buf.WriteString("<tr><td>" + html.EscapeString(to) + "</td><td>" + html.EscapeString(qe.Subject()) + "</td><td>" + qe.Queued.Format(time.RFC822) + "</td><td>" + strconv.Itoa(qe.Attempts) + "</td><td>")
+		if !retryButton {
+			buf.WriteString(qe.NextTry.Format(time.RFC822))
+		}
+		buf.WriteString("</td><td>" + html.EscapeString(qe.LastError) + "</td>")
+		if retryButton {
+			buf.WriteString("<td><form method=\"POST\" action=\"/admin/mail\">" + csrfField + "<input type=\"hidden\" name=\"retry\" value=\"" + html.EscapeString(qe.ID) + "\"><button type=\"submit\">Retry</button></form></td>")
+		}
+		buf.WriteString("</tr>")
+	}
+	buf.WriteString("</table>")
+	return buf.String()
+}
+
+// Show pending and failed email, and retry or clear failed email
+func (mq *MailQueue) adminOverview(state pinterface.IUserState) func(http.ResponseWriter, *http.Request) string {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		if !state.AdminRights(req) {
+			w.WriteHeader(http.StatusForbidden)
+			return "Permission denied."
+		}
+		msg := ""
+		if req.Method == "POST" && !ValidCSRF(state, req) {
+			w.WriteHeader(http.StatusForbidden)
+			msg = csrfMessage
+		} else if req.Method == "POST" {
+			if id := webhandle.GetFormParam(req, "retry"); id != "" {
+				if err := mq.Retry(id); err != nil {
+					msg = "Could not retry: " + html.EscapeString(err.Error())
+				} else {
+					msg = "The email has been queued again."
+				}
+			} else if webhandle.GetFormParam(req, "clear") != "" {
+				if err := mq.ClearFailed(); err != nil {
+					msg = "Could not clear the failed email: " + html.EscapeString(err.Error())
+				}
+			}
+		}
+		pending, err := mq.Pending()
+		if err != nil {
+			return "Could not read the email queue: " + html.EscapeString(err.Error())
+		}
+		failed, err := mq.Failed()
+		if err != nil {
+			return "Could not read the failed email: " + html.EscapeString(err.Error())
+		}
+		csrfField := CSRFField(state, req)
+		s := ""
+		if msg != "" {
+			s += "<div class=\"message\">" + msg + "</div>"
+		}
+		s += "<h3>Pending (" + strconv.Itoa(len(pending)) + ")</h3>" + emailTable(pending, false, "")
+		s += "<h3>Failed (" + strconv.Itoa(len(failed)) + ")</h3>" + emailTable(failed, true, csrfField)
+		if len(failed) > 0 {
+			s += "<form method=\"POST\" action=\"/admin/mail\">" + csrfField + "<input type=\"hidden\" name=\"clear\" value=\"1\"><button type=\"submit\">Clear failed email</button></form>"
+		}
+		return s
+	}
+}
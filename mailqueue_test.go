@@ -0,0 +1,217 @@
+package genericsite
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/xyproto/pinterface"
+)
+
+// A Mailer that fails the first n times
+type flakyMailer struct {
+	failures int
+	mm       *MemoryMailer
+}
+
+func (m *flakyMailer) Send(from string, to []string, msg []byte) error {
+	if m.failures > 0 {
+		m.failures--
+		return errors.New("server is down")
+	}
+	return m.mm.Send(from, to, msg)
+}
+
+func TestMailQueueRetries(t *testing.T) {
+	mm := NewMemoryMailer()
+	mq, err := NewMailQueue(&memCreator{}, &flakyMailer{2, mm})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mq.Send("a@example.com", []string{"b@example.com"}, []byte("Subject: hi\r\n\r\nhello\r\n"))
+
+	now := time.Now()
+	mq.Process(now)
+	pending, _ := mq.Pending()
+	if len(pending) != 1 || pending[0].Attempts != 1 || pending[0].LastError == "" {
+		t.Fatal("expected one pending email after the first failure")
+	}
+	if !pending[0].NextTry.Equal(now.Add(mq.InitialDelay)) {
+		t.Error("wrong delay after the first failure")
+	}
+
+	// Not due yet
+	mq.Process(now.Add(mq.InitialDelay / 2))
+	if pending, _ = mq.Pending(); pending[0].Attempts != 1 {
+		t.Error("the email was retried too early")
+	}
+
+	now = now.Add(mq.InitialDelay)
+	mq.Process(now)
+	if pending, _ = mq.Pending(); !pending[0].NextTry.Equal(now.Add(2 * mq.InitialDelay)) {
+		t.Error("the delay should double for every attempt")
+	}
+
+	mq.Process(now.Add(2 * mq.InitialDelay))
+	if pending, _ = mq.Pending(); len(pending) != 0 {
+		t.Error("the email should have been sent")
+	}
+	if len(mm.Sent()) != 1 || mm.Sent()[0].To[0] != "b@example.com" {
+		t.Error("the email was not sent")
+	}
+}
+
+func TestMailQueueDeadLetter(t *testing.T) {
+	mq, _ := NewMailQueue(&memCreator{}, &flakyMailer{100, NewMemoryMailer()})
+	mq.MaxAttempts = 3
+	mq.Send("a@example.com", []string{"b@example.com"}, []byte("Subject: hi\r\n\r\nhello\r\n"))
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		mq.Process(now)
+		now = now.Add(mq.MaxDelay)
+	}
+	pending, _ := mq.Pending()
+	failed, _ := mq.Failed()
+	if len(pending) != 0 || len(failed) != 1 {
+		t.Fatalf("expected the email to be moved to the failed list, got %d pending and %d failed", len(pending), len(failed))
+	}
+	if failed[0].Subject() != "hi" {
+		t.Error("wrong subject: " + failed[0].Subject())
+	}
+
+	if err := mq.Retry(failed[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	pending, _ = mq.Pending()
+	failed, _ = mq.Failed()
+	if len(pending) != 1 || len(failed) != 0 || pending[0].Attempts != 0 {
+		t.Error("expected the email to be queued again")
+	}
+}
+
+func TestMailQueueAdmin(t *testing.T) {
+	mq, _ := NewMailQueue(&memCreator{}, &flakyMailer{100, NewMemoryMailer()})
+	mq.MaxAttempts = 1
+	mq.Send("a@example.com", []string{"b@example.com"}, []byte("Subject: hi\r\n\r\nhello\r\n"))
+	mq.Process(time.Now())
+
+	state := newMemUserState()
+	state.AddUser("root", "rootpassword", "root@example.com")
+	state.SetAdminStatus("root")
+	state.SetLoggedIn("root")
+	admin := &http.Cookie{Name: "user", Value: "root"}
+	r := mux.NewRouter()
+	mq.ServePages(r, testBaseCP, state, testTVGF())
+
+	token, _ := csrfToken(state, "root")
+	if body := do(r, "GET", "/admin/mail", nil, admin).Body.String(); strings.Count(body, "value=\""+token+"\"") != 2 {
+		t.Error("expected the token in the retry and clear forms: " + body)
+	}
+	if w := do(r, "POST", "/admin/mail", url.Values{"clear": {"1"}}, admin); w.Code != http.StatusForbidden {
+		t.Error("expected the form to be refused without the token")
+	}
+	if failed, _ := mq.Failed(); len(failed) != 1 {
+		t.Fatal("the failed email should not be cleared without the token")
+	}
+	do(r, "POST", "/admin/mail", withCSRF(state, "root", url.Values{"clear": {"1"}}), admin)
+	if failed, _ := mq.Failed(); len(failed) != 0 {
+		t.Error("expected the failed email to be cleared")
+	}
+}
+
+func TestMailQueueShared(t *testing.T) {
+	// Two processes that share the same database
+	creator := &memCreator{}
+	mm := NewMemoryMailer()
+	a, _ := NewMailQueue(creator, mm)
+	b, _ := NewMailQueue(creator, mm)
+	a.Send("a@example.com", []string{"first@example.com"}, []byte("Subject: first\r\n\r\nhello\r\n"))
+	b.Send("a@example.com", []string{"second@example.com"}, []byte("Subject: second\r\n\r\nhello\r\n"))
+	pending, _ := a.Pending()
+	if len(pending) != 2 || pending[0].Subject() != "first" {
+		t.Fatal("expected the email from both processes, oldest first")
+	}
+
+	// a stops while sending the first email, which b leaves alone until the claim expires
+	now := time.Now()
+	if qe, _ := a.claim(pending[0], now); qe == nil {
+		t.Fatal("expected the email to be claimed")
+	}
+	b.Process(now)
+	if sent := mm.Sent(); len(sent) != 1 || sent[0].To[0] != "second@example.com" {
+		t.Fatalf("expected only the unclaimed email to be sent: %v", sent)
+	}
+	b.Process(now.Add(claimTimeout))
+	if len(mm.Sent()) != 2 {
+		t.Error("expected the email to be sent when the claim has expired")
+	}
+
+	// The queue is kept when the process restarts
+	a.Send("a@example.com", []string{"third@example.com"}, []byte("Subject: third\r\n\r\nhello\r\n"))
+	c, _ := NewMailQueue(creator, mm)
+	if pending, _ := c.Pending(); len(pending) != 1 || pending[0].Subject() != "third" {
+		t.Error("expected the queue to survive a restart")
+	}
+}
+
+func TestMailQueueClaimOnce(t *testing.T) {
+	// Several processes that try to send the same email at the same time
+	creator := &memCreator{}
+	mm := NewMemoryMailer()
+	queues := make([]*MailQueue, 8)
+	for i := range queues {
+		queues[i], _ = NewMailQueue(creator, mm)
+	}
+	queues[0].Send("a@example.com", []string{"once@example.com"}, []byte("Subject: once\r\n\r\nhello\r\n"))
+	now := time.Now()
+	var wg sync.WaitGroup
+	for _, mq := range queues {
+		wg.Add(1)
+		go func(mq *MailQueue) {
+			defer wg.Done()
+			mq.Process(now)
+		}(mq)
+	}
+	wg.Wait()
+	if sent := mm.Sent(); len(sent) != 1 {
+		t.Errorf("expected the email to be sent once, not %d times", len(sent))
+	}
+}
+
+// A hash map where the given owner can not be removed
+type undeletableHashMap struct {
+	pinterface.IHashMap
+	owner string
+}
+
+func (h undeletableHashMap) Del(owner string) error {
+	if owner == h.owner {
+		return errors.New("could not remove " + owner)
+	}
+	return h.IHashMap.Del(owner)
+}
+
+func TestMailQueueContinuesAfterErrors(t *testing.T) {
+	mm := NewMemoryMailer()
+	mq, _ := NewMailQueue(&memCreator{}, mm)
+	mq.Send("a@example.com", []string{"first@example.com"}, []byte("Subject: first\r\n\r\nhello\r\n"))
+	mq.Send("a@example.com", []string{"second@example.com"}, []byte("Subject: second\r\n\r\nhello\r\n"))
+	pending, _ := mq.Pending()
+	mq.pending = undeletableHashMap{mq.pending, pending[0].ID}
+
+	if err := mq.Process(time.Now()); err != nil {
+		t.Error(err)
+	}
+	if sent := mm.Sent(); len(sent) != 2 {
+		t.Fatalf("expected both emails to be sent, got %d", len(sent))
+	}
+	if pending, _ := mq.Pending(); len(pending) != 1 || pending[0].Subject() != "first" {
+		t.Error("expected only the email that could not be removed to be pending")
+	}
+}
@@ -6,19 +6,52 @@ import (
 	"github.com/xyproto/webhandle"
 	"net/http"
 	"strconv"
+	"sync"
 )
 
 type (
 	MenuEntry struct {
-		id   string
-		text string
-		url  string
+		id       string
+		text     string
+		url      string      // may be empty for entries that only have a submenu
+		children MenuEntries // shown in a dropdown
 	}
 	MenuEntries []*MenuEntry
 )
 
 var menuIdCounter = 0
 
+// Open and close the submenus with the buttons. Escape, or a click outside of the menu, closes them.
+const submenuJS = `function closeSubmenus(except) {
+  var entries = document.querySelectorAll(".menuEntry.open, .submenuEntry.open");
+  for (var i = 0; i < entries.length; i++) {
+    if (!entries[i].contains(except)) {
+      entries[i].classList.remove("open");
+      entries[i].querySelector(".submenutoggle").setAttribute("aria-expanded", "false");
+    }
+  }
+}
+function toggleSubmenu(button) {
+  var entry = button.parentNode;
+  var open = !entry.classList.contains("open");
+  closeSubmenus(entry);
+  entry.classList.toggle("open", open);
+  button.setAttribute("aria-expanded", open ? "true" : "false");
+}
+document.addEventListener("click", function (e) {
+  closeSubmenus(e.target);
+});
+document.addEventListener("keydown", function (e) {
+  if (e.key !== "Escape") {
+    return;
+  }
+  var entry = document.activeElement && document.activeElement.closest ? document.activeElement.closest(".menuEntry.open, .submenuEntry.open") : null;
+  closeSubmenus(null);
+  if (entry) {
+    entry.querySelector(".submenutoggle").focus();
+  }
+});`
+
 // Generate a new menu ID
 func (me *MenuEntry) autoId() string {
 	newId := ""
@@ -43,6 +76,24 @@ func NewMenuEntry(text_and_url string) *MenuEntry {
 	return &me
 }
 
+// Add an entry to the submenu of this entry, takes something like "Users:/admin/users".
+// Returns the new entry, so that it can have a submenu as well.
+func (me *MenuEntry) AddChild(text_and_url string) *MenuEntry {
+	child := NewMenuEntry(text_and_url)
+	me.children = append(me.children, child)
+	return child
+}
+
+// Add several entries to the submenu of this entry
+func (me *MenuEntry) AddChildren(links []string) {
+	me.children = append(me.children, Links2menuEntries(links)...)
+}
+
+// The entries in the submenu
+func (me *MenuEntry) Children() MenuEntries {
+	return me.children
+}
+
 func Links2menuEntries(links []string) MenuEntries {
 	menuEntries := make(MenuEntries, len(links))
 	for i, text_and_url := range links {
@@ -51,19 +102,22 @@ func Links2menuEntries(links []string) MenuEntries {
 	return menuEntries
 }
 
-// Generate tags for the menu based on a list of "MenuDescription:/menu/url"
+// Generate tags for the menu based on a list of "MenuDescription:/menu/url".
+// Entries with children get a button that shows the submenu as a dropdown.
 func MenuSnippet(menuEntries MenuEntries) *onthefly.Page {
-	var a, li, sep *onthefly.Tag
+	var sep *onthefly.Tag
 
 	page, ul := onthefly.StandaloneTag("ul")
 	ul.AddAttrib("class", "menuList")
+	// Shown and hidden by the menu toggle on narrow screens
+	ul.AddAttrib("id", "menulist")
 	//ul.AddStyle("list-style-type", "none")
 	//ul.AddStyle("float", "left")
 	//ul.AddStyle("margin", "0")
 
 	for i, menuEntry := range menuEntries {
 
-		li = ul.AddNewTag("li")
+		li := ul.AddNewTag("li")
 		li.AddAttrib("class", "menuEntry")
 
 		// TODO: Make sure not duplicate ids are added for two menu entries named "Hi there" and "Hi you". Add i to string?
@@ -83,16 +137,53 @@ func MenuSnippet(menuEntries MenuEntries) *onthefly.Page {
 			sep = li.AddNewTag("div")
 			sep.AddContent("|")
 			sep.AddAttrib("class", "separator")
+			// Not read by screen readers
+			sep.AddAttrib("aria-hidden", "true")
 		}
 
-		a = li.AddNewTag("a")
+		addMenuEntry(li, menuEntry)
+	}
+
+	return page
+}
+
+// Add the link of a menu entry to the given li tag, and the submenu, if there are children
+func addMenuEntry(li *onthefly.Tag, menuEntry *MenuEntry) {
+	if menuEntry.url != "" {
+		a := li.AddNewTag("a")
 		a.AddAttrib("class", "menulink")
 		a.AddAttrib("href", menuEntry.url)
 		a.AddContent(menuEntry.text)
+	}
+	if len(menuEntry.children) == 0 {
+		return
+	}
 
+	// The submenu is opened by a button, so that it works with the keyboard and on touch screens.
+	// The button has the text of the entry if there is no link.
+	submenuId := "submenu" + menuEntry.id
+	button := li.AddNewTag("button")
+	button.AddAttrib("class", "submenutoggle")
+	button.AddAttrib("type", "button")
+	button.AddAttrib("aria-expanded", "false")
+	button.AddAttrib("aria-controls", submenuId)
+	button.AddAttrib("onclick", "toggleSubmenu(this)")
+	if menuEntry.url == "" {
+		button.AddContent(menuEntry.text + " &#9662;")
+	} else {
+		button.AddAttrib("aria-label", "Show the submenu of "+menuEntry.text)
+		// Small triangle, pointing down
+		button.AddContent("&#9662;")
 	}
 
-	return page
+	ul := li.AddNewTag("ul")
+	ul.AddAttrib("class", "submenu")
+	ul.AddAttrib("id", submenuId)
+	for _, child := range menuEntry.children {
+		childLi := ul.AddNewTag("li")
+		childLi.AddAttrib("class", "submenuEntry")
+		addMenuEntry(childLi, child)
+	}
 }
 
 // Checks if a *MenuEntry exists in a []*MenuEntry (MenuEntries)
@@ -115,6 +206,82 @@ func AddIfNotAdded(url string, filteredMenuEntries *MenuEntries, menuEntry *Menu
 	//}
 }
 
+// The menu entries that should be shown, given the rights of the user.
+// Submenus are filtered in the same way, and an entry that is not shown hides its submenu as well.
+func filterMenuEntries(menuEntries MenuEntries, userRights, adminRights bool) MenuEntries {
+	var filteredMenuEntries MenuEntries
+	var logoutEntry *MenuEntry = nil
+
+	// Build up filteredMenuEntries based on what should be shown or not
+	for _, menuEntry := range menuEntries {
+
+		// The submenu is filtered the same way. The entries are shared by all requests, so they are copied.
+		if len(menuEntry.children) > 0 {
+			filtered := *menuEntry
+			filtered.children = filterMenuEntries(menuEntry.children, userRights, adminRights)
+			menuEntry = &filtered
+		}
+
+		// Entries without a link are shown if there is something in the submenu
+		if menuEntry.url == "" {
+			if len(menuEntry.children) > 0 {
+				filteredMenuEntries = append(filteredMenuEntries, menuEntry)
+			}
+			continue
+		}
+
+		// Don't add duplicates
+		if HasEntry(menuEntry, filteredMenuEntries) {
+			continue
+		}
+
+		// Add this one last
+		if menuEntry.url == "/logout" {
+			if userRights {
+				logoutEntry = menuEntry
+			}
+			continue
+		}
+
+		// Always show the Overview menu
+		AddIfNotAdded("/", &filteredMenuEntries, menuEntry)
+		//if menuEntry.url == "/" {
+		//	if !HasEntry(menuEntry, filteredMenuEntries) {
+		//		filteredMenuEntries = append(filteredMenuEntries, menuEntry)
+		//	}
+		//}
+
+		// If logged in, show Logout and the content
+		if userRights {
+
+			// Add every link except the current page we're on
+			//if menuEntry.url != currentMenuURL {
+			if !HasEntry(menuEntry, filteredMenuEntries) {
+				if (menuEntry.url != "/login") && (menuEntry.url != "/register") && (menuEntry.url != "/admin") {
+					filteredMenuEntries = append(filteredMenuEntries, menuEntry)
+				}
+			}
+			//}
+
+			// Show admin content
+			if adminRights {
+				AddIfNotAdded("/admin", &filteredMenuEntries, menuEntry)
+			}
+		} else {
+			// Only show Login and Register
+			AddIfNotAdded("/login", &filteredMenuEntries, menuEntry)
+			AddIfNotAdded("/register", &filteredMenuEntries, menuEntry)
+		}
+
+	}
+
+	if logoutEntry != nil {
+		AddIfNotAdded("/logout", &filteredMenuEntries, logoutEntry)
+	}
+
+	return filteredMenuEntries
+}
+
 /*
  * Functions that generate functions that generate content that can be used in templates.
  * type TemplateValues map[string]string
@@ -128,69 +295,29 @@ func AddIfNotAdded(url string, filteredMenuEntries *MenuEntries, menuEntry *Menu
 // TODO: Check the user status _once_, and the admin status _once_, then generate the menu
 // TODO: Some way of marking menu entries as user, admin or other rights. Add a group system?
 func DynamicMenuFactoryGenerator(menuEntries MenuEntries) TemplateValueGeneratorFactory {
+	// onthefly writes the attributes in random order, so every generated menu is kept,
+	// to give the same HTML for the same menu every time. This keeps ETags and cached pages valid.
+	var menuMut sync.Mutex
+	menus := make(map[string]string)
+
 	return func(state pinterface.IUserState) webhandle.TemplateValueGenerator {
 		return func(w http.ResponseWriter, req *http.Request) onthefly.TemplateValues {
+			defer TimingFrom(req).Measure("menu")()
 
 			userRights := state.UserRights(req)
 			adminRights := state.AdminRights(req)
 
-			var filteredMenuEntries MenuEntries
-			var logoutEntry *MenuEntry = nil
-
-			// Build up filteredMenuEntries based on what should be shown or not
-			for _, menuEntry := range menuEntries {
+			filteredMenuEntries := filterMenuEntries(menuEntries, userRights, adminRights)
 
-				// Don't add duplicates
-				if HasEntry(menuEntry, filteredMenuEntries) {
-					continue
-				}
-
-				// Add this one last
-				if menuEntry.url == "/logout" {
-					if userRights {
-						logoutEntry = menuEntry
-					}
-					continue
-				}
-
-				// Always show the Overview menu
-				AddIfNotAdded("/", &filteredMenuEntries, menuEntry)
-				//if menuEntry.url == "/" {
-				//	if !HasEntry(menuEntry, filteredMenuEntries) {
-				//		filteredMenuEntries = append(filteredMenuEntries, menuEntry)
-				//	}
-				//}
-
-				// If logged in, show Logout and the content
-				if userRights {
-
-					// Add every link except the current page we're on
-					//if menuEntry.url != currentMenuURL {
-					if !HasEntry(menuEntry, filteredMenuEntries) {
-						if (menuEntry.url != "/login") && (menuEntry.url != "/register") && (menuEntry.url != "/admin") {
-							filteredMenuEntries = append(filteredMenuEntries, menuEntry)
-						}
-					}
-					//}
-
-					// Show admin content
-					if adminRights {
-						AddIfNotAdded("/admin", &filteredMenuEntries, menuEntry)
-					}
-				} else {
-					// Only show Login and Register
-					AddIfNotAdded("/login", &filteredMenuEntries, menuEntry)
-					AddIfNotAdded("/register", &filteredMenuEntries, menuEntry)
-				}
-
-			}
-
-			if logoutEntry != nil {
-				AddIfNotAdded("/logout", &filteredMenuEntries, logoutEntry)
+			key := menuKey(filteredMenuEntries)
+			menuMut.Lock()
+			retval, ok := menus[key]
+			if !ok {
+				page := MenuSnippet(filteredMenuEntries)
+				retval = page.String()
+				menus[key] = retval
 			}
-
-			page := MenuSnippet(filteredMenuEntries)
-			retval := page.String()
+			menuMut.Unlock()
 
 			// TODO: Return the CSS as well somehow
 			//css := page.CSS()
@@ -200,6 +327,18 @@ func DynamicMenuFactoryGenerator(menuEntries MenuEntries) TemplateValueGenerator
 	}
 }
 
+// Identifies a filtered menu, including the submenus
+func menuKey(menuEntries MenuEntries) string {
+	key := ""
+	for _, menuEntry := range menuEntries {
+		key += menuEntry.id + "\n"
+		if len(menuEntry.children) > 0 {
+			key += "(\n" + menuKey(menuEntry.children) + ")\n"
+		}
+	}
+	return key
+}
+
 // Combines two TemplateValueGenerators into one TemplateValueGenerator by adding the strings per key
 func TemplateValueGeneratorCombinator(tvg1, tvg2 webhandle.TemplateValueGenerator) webhandle.TemplateValueGenerator {
 	return func(w http.ResponseWriter, req *http.Request) onthefly.TemplateValues {
@@ -0,0 +1,84 @@
+package genericsite
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// The texts of the menu entries, with the submenus in parentheses
+func menuTexts(menuEntries MenuEntries) string {
+	var texts []string
+	for _, menuEntry := range menuEntries {
+		text := menuEntry.text
+		if len(menuEntry.children) > 0 {
+			text += "(" + menuTexts(menuEntry.children) + ")"
+		}
+		texts = append(texts, text)
+	}
+	return strings.Join(texts, " ")
+}
+
+func TestNestedMenu(t *testing.T) {
+	overview := NewMenuEntry("Overview:/")
+	docs := NewMenuEntry("Docs:/docs")
+	docs.AddChild("Guide:/docs/guide").AddChildren([]string{"Install:/docs/install", "Admin:/admin"})
+	account := NewMenuEntry("Account:")
+	account.AddChildren([]string{"Logout:/logout", "Login:/login", "Register:/register", "Settings:/settings"})
+	menuEntries := MenuEntries{overview, docs, account}
+
+	for _, tc := range []struct {
+		userRights, adminRights bool
+		texts                   string
+	}{
+		// Docs is not shown, so neither is the submenu. Account is shown for the entries in the submenu.
+		{false, false, "Overview Account(Login Register)"},
+		{true, false, "Overview Docs(Guide(Install)) Account(Settings Logout)"},
+		{true, true, "Overview Docs(Guide(Install Admin)) Account(Settings Logout)"},
+	} {
+		if texts := menuTexts(filterMenuEntries(menuEntries, tc.userRights, tc.adminRights)); texts != tc.texts {
+			t.Errorf("expected %q, got %q", tc.texts, texts)
+		}
+	}
+	if len(docs.Children()) != 1 || len(docs.Children()[0].Children()) != 2 {
+		t.Error("filtering should not change the menu entries")
+	}
+
+	// The submenus are opened with buttons that tell if they are open
+	html := MenuSnippet(filterMenuEntries(menuEntries, true, true)).String()
+	toggle := findTag(html, "button", `aria-controls="submenu`+docs.id+`"`)
+	if !strings.Contains(toggle, `aria-expanded="false"`) || !strings.Contains(toggle, `aria-label="Show the submenu of Docs"`) {
+		t.Error("expected a button for the submenu: " + toggle)
+	}
+	if findTag(html, "ul", `id="submenu`+docs.id+`"`) == "" || findTag(html, "ul", `id="submenu`+docs.children[0].id+`"`) == "" {
+		t.Error("expected nested submenus: " + html)
+	}
+	if findTag(html, "a", `href="/docs/install"`) == "" || strings.Count(html, `class="separator"`) != 2 {
+		t.Error("expected links in the submenus, and separators only between the top level entries: " + html)
+	}
+	// Entries without a link only have the button
+	if !strings.Contains(html, "Account &#9662;</button>") {
+		t.Error("expected the text of an entry without a link in the button: " + html)
+	}
+
+	// The generated menu depends on the rights of the user
+	state := newMemUserState()
+	state.AddUser("bob", "hunter22", "bob@example.com")
+	state.SetLoggedIn("bob")
+	tvg := DynamicMenuFactoryGenerator(menuEntries)(state)
+	menu := func(cookies ...*http.Cookie) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		return tvg(httptest.NewRecorder(), req)["menu"]
+	}
+	bob := &http.Cookie{Name: "user", Value: "bob"}
+	if m := menu(); strings.Contains(m, "/docs/guide") || !strings.Contains(m, "/register") {
+		t.Error("expected the submenus to be filtered for visitors: " + m)
+	}
+	if m := menu(bob); !strings.Contains(m, "/docs/guide") || strings.Contains(m, "/admin") || menu(bob) != m {
+		t.Error("expected the same submenus for users every time: " + m)
+	}
+}
@@ -0,0 +1,293 @@
+package genericsite
+
+// Pages for users that have forgotten their password or username
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/xyproto/permissions2"
+	"github.com/xyproto/pinterface"
+	"github.com/xyproto/webhandle"
+)
+
+const (
+	// How long a password reset link is valid, by default
+	defaultResetTimeout = time.Hour
+
+	// The hash of the current reset token, in the Users() hash map
+	resetTokenField = "resetToken"
+
+	// The reset tokens, by the hash of the token, with the username and when the token expires
+	resetTokensID      = "reset_tokens"
+	resetUsernameField = "username"
+	resetExpiresField  = "expires"
+
+	// How many times each reset token has been used, by the hash of the token
+	resetUsesID = "reset_token_uses"
+)
+
+// Set how long a password reset link is valid
+func (ue *UserEngine) SetResetTimeout(timeout time.Duration) {
+	ue.resetTimeout = timeout
+}
+
+// Register the pages for resetting passwords with the router
+func (ue *UserEngine) serveRecoveryPages(r *mux.Router, basecp BaseCP, tvg webhandle.TemplateValueGenerator) {
+	ue.servePage(r, basecp, tvg, "/forgot-password", "Forgot password", ue.forgotPassword)
+	ue.servePage(r, basecp, tvg, "/reset/{token}", "Reset password", ue.resetPassword)
+	ue.servePage(r, basecp, tvg, "/forgot-username", "Forgot username", ue.forgotUsername)
+}
+
+// Generate a random token that can be used in a link
+func randomToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Only the hash of the token is stored, in case the database leaks
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// The reset tokens, by the hash of the token, so that the user can be found without going through all users
+func (ue *UserEngine) resetTokens() (pinterface.IHashMap, error) {
+	return ue.state.Creator().NewHashMap(resetTokensID)
+}
+
+// Generate and store a single-use password reset token for the given user.
+// Only the newest link for a user is valid.
+func (ue *UserEngine) NewResetToken(username string) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	tokens, err := ue.resetTokens()
+	if err != nil {
+		return "", err
+	}
+	ue.RemoveResetToken(username)
+	ue.removeExpiredResetTokens()
+	hashedToken := hashToken(token)
+	expires := time.Now().Add(ue.resetTimeout).Unix()
+	if err := tokens.Set(hashedToken, resetExpiresField, strconv.FormatInt(expires, 10)); err != nil {
+		return "", err
+	}
+	if err := tokens.Set(hashedToken, resetUsernameField, username); err != nil {
+		return "", err
+	}
+	if err := ue.state.Users().Set(username, resetTokenField, hashedToken); err != nil {
+		tokens.Del(hashedToken)
+		return "", err
+	}
+	return token, nil
+}
+
+// Find the user that has the given reset token, if it has not expired
+func (ue *UserEngine) FindUserByResetToken(token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	tokens, err := ue.resetTokens()
+	if err != nil {
+		return "", false
+	}
+	hashedToken := hashToken(token)
+	username, err := tokens.Get(hashedToken, resetUsernameField)
+	if err != nil || username == "" {
+		return "", false
+	}
+	// The token must still be the current one for the user
+	storedHash, err := ue.state.Users().Get(username, resetTokenField)
+	if err != nil || subtle.ConstantTimeCompare([]byte(storedHash), []byte(hashedToken)) != 1 {
+		return "", false
+	}
+	expiresString, err := tokens.Get(hashedToken, resetExpiresField)
+	if err != nil {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(expiresString, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		// Expired, clean up
+		ue.RemoveResetToken(username)
+		return "", false
+	}
+	return username, true
+}
+
+// Use up the given reset token. Only the first caller gets true, also when several
+// requests with the same link are handled at the same time, by one or more servers.
+func (ue *UserEngine) useResetToken(token string) bool {
+	uses, err := ue.state.Creator().NewKeyValue(resetUsesID)
+	if err != nil {
+		return false
+	}
+	count, err := uses.Inc(hashToken(token))
+	return err == nil && count == "1"
+}
+
+// Remove the reset token for the given user, so that it can not be reused.
+// When it expires is kept, so that the count of uses can be removed after that.
+func (ue *UserEngine) RemoveResetToken(username string) {
+	users := ue.state.Users()
+	if hashedToken, err := users.Get(username, resetTokenField); err == nil && hashedToken != "" {
+		if tokens, err := ue.resetTokens(); err == nil {
+			tokens.DelKey(hashedToken, resetUsernameField)
+		}
+	}
+	users.DelKey(username, resetTokenField)
+}
+
+// Remove the reset tokens that have expired, and how many times they have been used.
+// The count of uses is kept until then, since a request that found the token
+// before it was removed may still try to use it.
+func (ue *UserEngine) removeExpiredResetTokens() {
+	tokens, err := ue.resetTokens()
+	if err != nil {
+		return
+	}
+	uses, err := ue.state.Creator().NewKeyValue(resetUsesID)
+	if err != nil {
+		return
+	}
+	hashedTokens, err := tokens.All()
+	if err != nil {
+		return
+	}
+	now := time.Now().Unix()
+	for _, hashedToken := range hashedTokens {
+		expiresString, err := tokens.Get(hashedToken, resetExpiresField)
+		if err != nil {
+			continue
+		}
+		if expires, err := strconv.ParseInt(expiresString, 10, 64); err == nil && now <= expires {
+			continue
+		}
+		if err := uses.Del(hashedToken); err != nil {
+			log.Println("Could not remove the uses of an expired password reset token: " + err.Error())
+			continue
+		}
+		tokens.Del(hashedToken)
+	}
+}
+
+// Show the form for requesting a password reset link, or send the link
+func (ue *UserEngine) forgotPassword(w http.ResponseWriter, req *http.Request) string {
+	if req.Method != "POST" {
+		return ForgotPasswordForm()
+	}
+	email := UserInput(webhandle.GetFormParam(req, "email"))
+	if email == "" {
+		return MessageAndForm("Please fill in the email address.", ForgotPasswordForm())
+	}
+	// Respond the same way, no matter if the address is registered or not.
+	// The emails are sent in the background, so that the response time does not tell either.
+	// Errors are logged, since they can not be shown. Use a MailQueue for retrying.
+	baseURL, domain := BaseURL(req), Domain(req)
+	ue.background.Add(1)
+	go func() {
+		defer ue.background.Done()
+		for _, username := range UsernamesByEmail(ue.state, string(email)) {
+			token, err := ue.NewResetToken(username)
+			if err != nil {
+				log.Println("Could not create a password reset token for " + username + ": " + err.Error())
+				continue
+			}
+			if err := ue.email.ResetPasswordEmail(domain, baseURL+"/reset/"+token, username, string(email)); err != nil {
+				log.Println("Could not send the password reset email for " + username + ": " + err.Error())
+			}
+		}
+	}()
+	return "If " + email.HTML() + " is registered, a link for resetting the password has been sent to it."
+}
+
+// Wait for the email that is sent in the background
+func (ue *UserEngine) wait() {
+	ue.background.Wait()
+}
+
+// Show the form for choosing a new password, or set the new password
+func (ue *UserEngine) resetPassword(w http.ResponseWriter, req *http.Request) string {
+	token := UserInput(mux.Vars(req)["token"])
+	username, ok := ue.FindUserByResetToken(string(token))
+	if !ok {
+		return "The password reset link is no longer valid. You can <a href=\"/forgot-password\">request a new one</a>."
+	}
+	resetForm := ResetPasswordForm("/reset/" + string(token))
+	if req.Method != "POST" {
+		return "Choose a new password for " + html.EscapeString(username) + "." + resetForm
+	}
+	password1 := UserInput(webhandle.GetFormParam(req, "password1"))
+	password2 := UserInput(webhandle.GetFormParam(req, "password2"))
+	if err := permissions.ValidUsernamePassword(username, string(password1)); err != nil {
+		return MessageAndForm("Invalid password: "+html.EscapeString(err.Error())+".", resetForm)
+	}
+	if len(password1) < minimumPasswordLength {
+		return MessageAndForm("The password is too short.", resetForm)
+	}
+	if password1 != password2 {
+		return MessageAndForm("The passwords do not match.", resetForm)
+	}
+	// The token is used up before the password is changed, so that the same link can only be used once
+	if !ue.useResetToken(string(token)) {
+		return "The password reset link has already been used. You can <a href=\"/forgot-password\">request a new one</a>."
+	}
+	ue.RemoveResetToken(username)
+	ue.state.SetPassword(username, string(password1))
+	return "The password has been changed. You may now <a href=\"/login\">log in</a>."
+}
+
+// Show the form for requesting the username, or send the username(s) by email
+func (ue *UserEngine) forgotUsername(w http.ResponseWriter, req *http.Request) string {
+	if req.Method != "POST" {
+		return ForgotUsernameForm()
+	}
+	email := UserInput(webhandle.GetFormParam(req, "email"))
+	if email == "" {
+		return MessageAndForm("Please fill in the email address.", ForgotUsernameForm())
+	}
+	// Respond the same way, no matter if the address is registered or not
+	domain := Domain(req)
+	ue.background.Add(1)
+	go func() {
+		defer ue.background.Done()
+		usernames := UsernamesByEmail(ue.state, string(email))
+		if len(usernames) > 0 {
+			if err := ue.email.ForgotUsernameEmail(domain, usernames, string(email)); err != nil {
+				log.Println("Could not send the forgotten username to " + string(email) + ": " + err.Error())
+			}
+		}
+	}()
+	return "If " + email.HTML() + " is registered, the username has been sent to it."
+}
+
+// Form for requesting the username, posts "email" to /forgot-username
+func ForgotUsernameForm() string {
+	return form("forgotUsernameForm", "/forgot-username", "Send",
+		formField("Email:", "email", "email"))
+}
+
+// Form for requesting a password reset link, posts "email" to /forgot-password
+func ForgotPasswordForm() string {
+	return form("forgotPasswordForm", "/forgot-password", "Send",
+		formField("Email:", "email", "email"))
+}
+
+// Form for choosing a new password, posts "password1" and "password2" to the given url
+func ResetPasswordForm(action string) string {
+	return form("resetPasswordForm", action, "Change password",
+		formField("New password:", "password1", "password"),
+		formField("Confirm password:", "password2", "password"))
+}
@@ -0,0 +1,154 @@
+package genericsite
+
+// Pages that are compiled once, and only rendered with new template values for every request
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/drbawb/mustache"
+	"github.com/xyproto/onthefly"
+	"github.com/xyproto/webhandle"
+)
+
+// Pages that are wrapped around dynamic contents have this placeholder for the contents
+const wrappedContentKey = "wrappedcontent"
+
+type (
+	// Rendered pages, by the template values they were rendered with.
+	// When full, the oldest page is removed.
+	RenderCache struct {
+		size  int
+		mut   sync.Mutex
+		pages map[string]string
+		keys  []string // oldest first
+	}
+
+	// The compiled template of a page
+	CompiledPage struct {
+		tmpl  *mustache.Template
+		xml   string // used if the template could not be compiled
+		cache *RenderCache
+	}
+)
+
+// Create a cache that holds up to size rendered pages
+func NewRenderCache(size int) *RenderCache {
+	return &RenderCache{size: size, pages: make(map[string]string)}
+}
+
+// A key that is the same for the same template values, no matter the order
+func renderKey(values onthefly.TemplateValues) string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	for _, key := range keys {
+		// The lengths keep keys and values apart, whatever they contain
+		fmt.Fprintf(&sb, "%d:%s%d:%s", len(key), key, len(values[key]), values[key])
+	}
+	return sb.String()
+}
+
+// Find a page that has been rendered with the given template values
+func (rc *RenderCache) Get(values onthefly.TemplateValues) (string, bool) {
+	rc.mut.Lock()
+	defer rc.mut.Unlock()
+	page, ok := rc.pages[renderKey(values)]
+	return page, ok
+}
+
+// Store a page that has been rendered with the given template values
+func (rc *RenderCache) Put(values onthefly.TemplateValues, page string) {
+	if rc.size <= 0 {
+		return
+	}
+	key := renderKey(values)
+	rc.mut.Lock()
+	defer rc.mut.Unlock()
+	if _, ok := rc.pages[key]; ok {
+		return
+	}
+	if len(rc.keys) >= rc.size {
+		delete(rc.pages, rc.keys[0])
+		rc.keys = rc.keys[1:]
+	}
+	rc.pages[key] = page
+	rc.keys = append(rc.keys, key)
+}
+
+// The number of rendered pages in the cache
+func (rc *RenderCache) Len() int {
+	rc.mut.Lock()
+	defer rc.mut.Unlock()
+	return len(rc.pages)
+}
+
+// Compile the page as a template. If cacheSize is larger than 0, that many rendered pages are cached.
+func CompilePage(page *onthefly.Page, cacheSize int) *CompiledPage {
+	cpage := &CompiledPage{xml: page.GetXML(true)}
+	if tmpl, err := mustache.ParseString(cpage.xml); err == nil {
+		cpage.tmpl = tmpl
+	}
+	if cacheSize > 0 {
+		cpage.cache = NewRenderCache(cacheSize)
+	}
+	return cpage
+}
+
+// Render the page with the given template values
+func (cpage *CompiledPage) Render(values onthefly.TemplateValues) string {
+	if cpage.cache != nil {
+		if s, ok := cpage.cache.Get(values); ok {
+			return s
+		}
+	}
+	var s string
+	if cpage.tmpl != nil {
+		s = cpage.tmpl.Render(values)
+	} else {
+		// Let mustache deal with the template in the same way as before it was compiled
+		s = mustache.Render(cpage.xml, values)
+	}
+	if cpage.cache != nil {
+		cpage.cache.Put(values, s)
+	}
+	return s
+}
+
+// Create a web.go compatible function that renders the compiled page, with optional caching
+func CompileHTMLwithTemplate(page *onthefly.Page, tvg webhandle.TemplateValueGenerator, cacheSize int) func(http.ResponseWriter, *http.Request) {
+	return CompilePage(page, cacheSize).Handler(tvg)
+}
+
+// Create a web.go compatible function that renders the compiled page.
+// Responds with 304 Not Modified if the client already has the page, as rendered for this request.
+func (cpage *CompiledPage) Handler(tvg webhandle.TemplateValueGenerator) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		rt, req := timingFor(req)
+		done := rt.Measure("values")
+		values := tvg(w, req)
+		done()
+		done = rt.Measure("render")
+		html := cpage.Render(withGeneratedIn(values))
+		done()
+		serveHTML(w, req, http.StatusOK, rt, html)
+	}
+}
+
+// Render the page with the given contents and serve it
+func (cpage *CompiledPage) serveWrapped(w http.ResponseWriter, req *http.Request, rt *RequestTiming, status int, content string, tvg webhandle.TemplateValueGenerator) {
+	done := rt.Measure("values")
+	values := withGeneratedIn(tvg(w, req))
+	done()
+	values[wrappedContentKey] = content
+	done = rt.Measure("render")
+	html := cpage.Render(values)
+	done()
+	serveHTML(w, req, status, rt, html)
+}
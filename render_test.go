@@ -0,0 +1,73 @@
+package genericsite
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/drbawb/mustache"
+	"github.com/xyproto/onthefly"
+)
+
+func testValues(user string) onthefly.TemplateValues {
+	return onthefly.TemplateValues{"menu": "<a href=\"/\">Overview</a>", "username": user}
+}
+
+func TestCompiledPage(t *testing.T) {
+	page := genericPageBuilder(DefaultCP(nil))
+	page.AddContent("Hi {{username}}")
+	// The order of the attributes may differ every time the XML is generated
+	cpage := CompilePage(page, 2)
+	for _, user := range []string{"alice", "bob", "alice", "carol", "dave"} {
+		if cpage.Render(testValues(user)) != mustache.Render(cpage.xml, testValues(user)) {
+			t.Error("the compiled page should render like the template")
+		}
+	}
+	if !strings.Contains(cpage.Render(testValues("erin")), "Hi erin") {
+		t.Error("expected the template values in the page")
+	}
+	if cpage.cache.Len() != 2 {
+		t.Errorf("expected 2 cached pages, got %d", cpage.cache.Len())
+	}
+}
+
+func TestRenderKey(t *testing.T) {
+	a := renderKey(onthefly.TemplateValues{"a": "b", "c": "d"})
+	b := renderKey(onthefly.TemplateValues{"c": "d", "a": "b"})
+	c := renderKey(onthefly.TemplateValues{"a": "bc", "": "d"})
+	if a != b || a == c {
+		t.Error("the key should only depend on the values")
+	}
+}
+
+func BenchmarkRenderEveryTime(b *testing.B) {
+	page := genericPageBuilder(DefaultCP(nil))
+	values := testValues("alice")
+	for i := 0; i < b.N; i++ {
+		mustache.Render(page.GetXML(true), values)
+	}
+}
+
+func BenchmarkRenderCompiled(b *testing.B) {
+	cpage := CompilePage(genericPageBuilder(DefaultCP(nil)), 0)
+	values := testValues("alice")
+	for i := 0; i < b.N; i++ {
+		cpage.Render(values)
+	}
+}
+
+func BenchmarkRenderCached(b *testing.B) {
+	cpage := CompilePage(genericPageBuilder(DefaultCP(nil)), 16)
+	values := testValues("alice")
+	for i := 0; i < b.N; i++ {
+		cpage.Render(values)
+	}
+}
+
+func BenchmarkServeCompiled(b *testing.B) {
+	handler := CompileHTMLwithTemplate(genericPageBuilder(DefaultCP(nil)), testTVGF()(newMemUserState()), 0)
+	req := httptest.NewRequest("GET", "/", nil)
+	for i := 0; i < b.N; i++ {
+		handler(httptest.NewRecorder(), req)
+	}
+}
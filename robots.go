@@ -0,0 +1,147 @@
+package genericsite
+
+// Generate robots.txt, as described at https://www.robotstxt.org/
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type (
+	// Rules for one user agent, or for all of them if UserAgent is "*" or empty
+	RobotsRule struct {
+		UserAgent  string
+		Allow      []string
+		Disallow   []string
+		CrawlDelay int // seconds, 0 is not included
+	}
+
+	// Generates robots.txt. Pages in the sitemap that require login are disallowed for every user agent.
+	Robots struct {
+		mut      sync.RWMutex
+		sitemap  *Sitemap
+		rules    []*RobotsRule
+		override string
+	}
+)
+
+// Create a robots.txt generator. If the override file exists, it is served instead of the generated robots.txt.
+// The sitemap may be nil.
+func NewRobots(sm *Sitemap, override string) *Robots {
+	return &Robots{sitemap: sm, override: override}
+}
+
+// Add rules for a user agent. Rules for the same user agent are merged.
+func (rb *Robots) AddRule(rule *RobotsRule) {
+	rb.mut.Lock()
+	rb.rules = append(rb.rules, rule)
+	rb.mut.Unlock()
+}
+
+// Paths in the sitemap that require login, sorted
+func (rb *Robots) loginPaths() []string {
+	if rb.sitemap == nil {
+		return nil
+	}
+	var paths []string
+	seen := make(map[string]bool)
+	for _, entry := range rb.sitemap.AllEntries() {
+		if entry.RequiresLogin && !seen[entry.Loc] {
+			seen[entry.Loc] = true
+			paths = append(paths, entry.Loc)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Add the values that are not already in the list
+func appendNew(list []string, values ...string) []string {
+NEXT:
+	for _, value := range values {
+		for _, existing := range list {
+			if existing == value {
+				continue NEXT
+			}
+		}
+		list = append(list, value)
+	}
+	return list
+}
+
+// Generate robots.txt. The Sitemap line is only included if there is a sitemap.
+func (rb *Robots) Generate(baseURL string) string {
+	rb.mut.RLock()
+	defer rb.mut.RUnlock()
+
+	// Merge the rules per user agent, with "*" first
+	merged := []*RobotsRule{{UserAgent: "*"}}
+	byAgent := map[string]*RobotsRule{"*": merged[0]}
+	for _, rule := range rb.rules {
+		agent := rule.UserAgent
+		if agent == "" {
+			agent = "*"
+		}
+		m, ok := byAgent[agent]
+		if !ok {
+			m = &RobotsRule{UserAgent: agent}
+			byAgent[agent] = m
+			merged = append(merged, m)
+		}
+		m.Allow = appendNew(m.Allow, rule.Allow...)
+		m.Disallow = appendNew(m.Disallow, rule.Disallow...)
+		if rule.CrawlDelay > 0 {
+			m.CrawlDelay = rule.CrawlDelay
+		}
+	}
+
+	// Crawlers only follow the most specific section, so every section needs the login paths
+	loginPaths := rb.loginPaths()
+
+	var buf bytes.Buffer
+	for i, rule := range merged {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		buf.WriteString("User-agent: " + rule.UserAgent + "\n")
+		for _, path := range rule.Allow {
+			buf.WriteString("Allow: " + path + "\n")
+		}
+		disallow := appendNew(append([]string{}, loginPaths...), rule.Disallow...)
+		if len(disallow) == 0 && len(rule.Allow) == 0 {
+			// An empty Disallow allows everything
+			buf.WriteString("Disallow:\n")
+		}
+		for _, path := range disallow {
+			buf.WriteString("Disallow: " + path + "\n")
+		}
+		if rule.CrawlDelay > 0 {
+			buf.WriteString("Crawl-delay: " + strconv.Itoa(rule.CrawlDelay) + "\n")
+		}
+	}
+	if rb.sitemap != nil {
+		buf.WriteString("\nSitemap: " + baseURL + "/sitemap.xml\n")
+	}
+	return buf.String()
+}
+
+// Serve robots.txt, either the override file or a generated one.
+// The link to the sitemap starts with the site URL from SetSiteURL, and only with the Host of the request if it is not set.
+func (rb *Robots) ServePages(r *mux.Router) {
+	r.HandleFunc("/robots.txt", func(w http.ResponseWriter, req *http.Request) {
+		if rb.override != "" {
+			if fi, err := os.Stat(rb.override); err == nil && !fi.IsDir() {
+				http.ServeFile(w, req, rb.override)
+				return
+			}
+		}
+		serveGenerated(w, req, []byte(rb.Generate(BaseURL(req))), "text/plain; charset=utf-8", documentCacheControl, time.Time{})
+	})
+}
@@ -0,0 +1,65 @@
+package genericsite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRobots(t *testing.T) {
+	sm := NewSitemap()
+	sm.Add(&SitemapEntry{Loc: "/"})
+	sm.AddEngine(NewAdminEngine(newMemUserState()))
+	rb := NewRobots(sm, "")
+	rb.AddRule(&RobotsRule{Disallow: []string{"/tmp"}})
+	rb.AddRule(&RobotsRule{UserAgent: "BadBot", Disallow: []string{"/"}, CrawlDelay: 10})
+	r := mux.NewRouter()
+	rb.ServePages(r)
+
+	body := do(r, "GET", "/robots.txt", nil).Body.String()
+	expected := `User-agent: *
+Disallow: /admin
+Disallow: /tmp
+
+User-agent: BadBot
+Disallow: /admin
+Disallow: /
+Crawl-delay: 10
+
+Sitemap: http://example.com/sitemap.xml
+`
+	if body != expected {
+		t.Error("unexpected robots.txt:\n" + body)
+	}
+
+	SetSiteURL("https://example.org")
+	defer SetSiteURL("")
+	if body = do(r, "GET", "http://attacker.example/robots.txt", nil).Body.String(); !strings.HasSuffix(body, "Sitemap: https://example.org/sitemap.xml\n") {
+		t.Error("expected the site URL in robots.txt:\n" + body)
+	}
+}
+
+func TestRobotsOverride(t *testing.T) {
+	dir, err := ioutil.TempDir("", "robots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	override := filepath.Join(dir, "robots.txt")
+
+	r := mux.NewRouter()
+	NewRobots(nil, override).ServePages(r)
+	if body := do(r, "GET", "/robots.txt", nil).Body.String(); body != "User-agent: *\nDisallow:\n" {
+		t.Error("expected a generated robots.txt without a sitemap:\n" + body)
+	}
+	if err := ioutil.WriteFile(override, []byte("User-agent: *\nDisallow: /static\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if body := do(r, "GET", "/robots.txt", nil).Body.String(); !strings.Contains(body, "Disallow: /static") {
+		t.Error("expected the static robots.txt:\n" + body)
+	}
+}
@@ -0,0 +1,319 @@
+package genericsite
+
+// Search through the published content pages
+
+import (
+	"bytes"
+	"html"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"github.com/xyproto/pinterface"
+	"github.com/xyproto/webhandle"
+)
+
+const (
+	defaultResultsPerPage = 10
+	snippetRadius         = 80  // characters of context before and after the first hit
+	titleWeight           = 5   // a hit in the title counts as much as this many hits in the text
+	allTermsBonus         = 100 // pages that contain all the search terms come first
+)
+
+type (
+	// A page that can be searched
+	searchPage struct {
+		url       string
+		title     string
+		text      string // the content without tags
+		lowTitle  []rune
+		lowText   []rune
+		textRunes []rune
+	}
+
+	// A search hit
+	SearchResult struct {
+		URL     string
+		Title   string
+		Snippet string // HTML, with the search terms highlighted
+		Score   int
+	}
+
+	// Indexes the title and text of content pages
+	SearchEngine struct {
+		pages          []*searchPage
+		ResultsPerPage int // the default is used if this is 0 or less
+	}
+)
+
+// Index the given content pages.
+// Pages that require login are left out, since anyone can search and the results show parts of the text.
+func NewSearchEngine(pc PageCollection) *SearchEngine {
+	se := &SearchEngine{ResultsPerPage: defaultResultsPerPage}
+	for _, cp := range pc {
+		if cp.RequiresLogin {
+			continue
+		}
+		se.AddPage(cp.Url, cp.ContentTitle, cp.ContentHTML)
+	}
+	return se
+}
+
+// Serve search results at the SearchURL of the base content page
+func ServeSearch(r *mux.Router, basecp BaseCP, userState pinterface.IUserState, pc PageCollection, tvgf TemplateValueGeneratorFactory) *SearchEngine {
+	se := NewSearchEngine(pc)
+	se.ServePages(r, basecp, userState, tvgf)
+	return se
+}
+
+// Register the search results page with the router
+func (se *SearchEngine) ServePages(r *mux.Router, basecp BaseCP, userState pinterface.IUserState, tvgf TemplateValueGeneratorFactory) {
+	cp := basecp(userState)
+	cp.ContentTitle = "Search"
+	cp.Url = cp.SearchURL
+	r.HandleFunc(cp.SearchURL, cp.WrapSimpleContextHandle(r, se.resultsPage(cp.SearchURL), tvgf(userState)))
+}
+
+// Add a page to the index
+func (se *SearchEngine) AddPage(url, title, contentHTML string) {
+	text := StripTags(contentHTML)
+	se.pages = append(se.pages, &searchPage{
+		url:       url,
+		title:     title,
+		text:      text,
+		lowTitle:  lowerRunes(title),
+		lowText:   lowerRunes(text),
+		textRunes: []rune(text),
+	})
+}
+
+// Remove HTML tags, scripts and styles, and unescape entities
+func StripTags(s string) string {
+	var buf bytes.Buffer
+	lower := strings.ToLower(s)
+	for i := 0; i < len(s); {
+		if s[i] != '<' {
+			buf.WriteByte(s[i])
+			i++
+			continue
+		}
+		// Skip the contents of script and style tags
+		for _, tagName := range []string{"script", "style"} {
+			if strings.HasPrefix(lower[i:], "<"+tagName) {
+				if end := strings.Index(lower[i:], "</"+tagName); end >= 0 {
+					i += end + 1
+				}
+			}
+		}
+		end := strings.IndexByte(s[i:], '>')
+		if end < 0 {
+			break
+		}
+		i += end + 1
+		// Tags separate words
+		buf.WriteByte(' ')
+	}
+	return strings.Join(strings.Fields(html.UnescapeString(buf.String())), " ")
+}
+
+// Lowercase every rune, keeping the number of runes the same
+func lowerRunes(s string) []rune {
+	runes := []rune(s)
+	for i, r := range runes {
+		runes[i] = unicode.ToLower(r)
+	}
+	return runes
+}
+
+// Split a search query into lowercase terms
+func searchTerms(query string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	var terms []string
+	seen := make(map[string]bool)
+	for _, term := range fields {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// Find the positions of all occurrences of term in text
+func indexAll(text, term []rune) []int {
+	var positions []int
+	if len(term) == 0 {
+		return positions
+	}
+NEXT:
+	for i := 0; i+len(term) <= len(text); i++ {
+		for j, r := range term {
+			if text[i+j] != r {
+				continue NEXT
+			}
+		}
+		positions = append(positions, i)
+	}
+	return positions
+}
+
+// Search for pages containing any of the words in the query, best hits first
+func (se *SearchEngine) Search(query string) []*SearchResult {
+	terms := searchTerms(query)
+	var results []*SearchResult
+	if len(terms) == 0 {
+		return results
+	}
+	for _, page := range se.pages {
+		score, found, first := 0, 0, -1
+		for _, term := range terms {
+			t := []rune(term)
+			titleHits := len(indexAll(page.lowTitle, t))
+			textHits := indexAll(page.lowText, t)
+			if titleHits+len(textHits) > 0 {
+				found++
+			}
+			score += titleHits*titleWeight + len(textHits)
+			if len(textHits) > 0 && (first < 0 || textHits[0] < first) {
+				first = textHits[0]
+			}
+		}
+		if score == 0 {
+			continue
+		}
+		if found == len(terms) {
+			score += allTermsBonus
+		}
+		results = append(results, &SearchResult{
+			URL:     page.url,
+			Title:   page.title,
+			Snippet: page.snippet(first, terms),
+			Score:   score,
+		})
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	return results
+}
+
+// A piece of the text around the given position, with the terms highlighted
+func (page *searchPage) snippet(pos int, terms []string) string {
+	if pos < 0 {
+		pos = 0
+	}
+	start := pos - snippetRadius
+	end := pos + snippetRadius
+	if start < 0 {
+		start = 0
+	}
+	if end > len(page.textRunes) {
+		end = len(page.textRunes)
+	}
+	// Don't cut words in half
+	for start > 0 && !unicode.IsSpace(page.textRunes[start-1]) {
+		start--
+	}
+	for end < len(page.textRunes) && !unicode.IsSpace(page.textRunes[end]) {
+		end++
+	}
+	s := Highlight(page.textRunes[start:end], page.lowText[start:end], terms)
+	if start > 0 {
+		s = "…" + s
+	}
+	if end < len(page.textRunes) {
+		s += "…"
+	}
+	return s
+}
+
+// HTML escape the text and wrap the search terms in <mark> tags.
+// low must be the lowercase version of text.
+func Highlight(text, low []rune, terms []string) string {
+	marked := make([]bool, len(text))
+	for _, term := range terms {
+		t := []rune(term)
+		for _, i := range indexAll(low, t) {
+			for j := range t {
+				marked[i+j] = true
+			}
+		}
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(text); {
+		j := i
+		for j < len(text) && marked[j] == marked[i] {
+			j++
+		}
+		if marked[i] {
+			buf.WriteString("<mark>" + html.EscapeString(string(text[i:j])) + "</mark>")
+		} else {
+			buf.WriteString(html.EscapeString(string(text[i:j])))
+		}
+		i = j
+	}
+	return buf.String()
+}
+
+// Generate the search results page, given the URL of the search page
+func (se *SearchEngine) resultsPage(searchURL string) func(http.ResponseWriter, *http.Request) string {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		query := UserInput(webhandle.GetParam(req, "q"))
+		if strings.TrimSpace(string(query)) == "" {
+			return "Please enter something to search for."
+		}
+		page, err := strconv.Atoi(webhandle.GetParam(req, "p"))
+		if err != nil || page < 1 {
+			page = 1
+		}
+		results := se.Search(string(query))
+		if len(results) == 0 {
+			return "No results for <b>" + query.HTML() + "</b>."
+		}
+
+		perPage := se.ResultsPerPage
+		if perPage <= 0 {
+			perPage = defaultResultsPerPage
+		}
+		pages := (len(results) + perPage - 1) / perPage
+		if page > pages {
+			page = pages
+		}
+		first := (page - 1) * perPage
+		last := first + perPage
+		if last > len(results) {
+			last = len(results)
+		}
+
+		var buf bytes.Buffer
+		buf.WriteString("<div class=\"searchinfo\">Showing " + strconv.Itoa(first+1) + "-" + strconv.Itoa(last) + " of " + strconv.Itoa(len(results)) + " results for <b>" + query.HTML() + "</b></div>")
+		buf.WriteString("<ol class=\"searchresults\" start=\"" + strconv.Itoa(first+1) + "\">")
+		for _, result := range results[first:last] {
+			buf.WriteString("<li class=\"searchresult\"><a href=\"" + html.EscapeString(result.URL) + "\">" + html.EscapeString(result.Title) + "</a><div class=\"snippet\">" + result.Snippet + "</div></li>")
+		}
+		buf.WriteString("</ol>")
+
+		// Links to the previous and next page of results
+		pageURL := func(p int) string {
+			return html.EscapeString(searchURL + "?q=" + url.QueryEscape(string(query)) + "&p=" + strconv.Itoa(p))
+		}
+		if pages > 1 {
+			buf.WriteString("<div class=\"pagination\">")
+			if page > 1 {
+				buf.WriteString("<a href=\"" + pageURL(page-1) + "\">Previous</a> ")
+			}
+			buf.WriteString("Page " + strconv.Itoa(page) + " of " + strconv.Itoa(pages))
+			if page < pages {
+				buf.WriteString(" <a href=\"" + pageURL(page+1) + "\">Next</a>")
+			}
+			buf.WriteString("</div>")
+		}
+		return buf.String()
+	}
+}
@@ -0,0 +1,68 @@
+package genericsite
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestStripTags(t *testing.T) {
+	s := StripTags("<h1>Fish &amp; chips</h1><script>var x = '<b>';</script><p>are <i>tasty</i></p>")
+	if s != "Fish & chips are tasty" {
+		t.Error("unexpected text: " + s)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	pc := PageCollection{
+		{Url: "/a", ContentTitle: "Gophers", ContentHTML: "<p>All about the <b>gopher</b>, a burrowing rodent.</p>"},
+		{Url: "/b", ContentTitle: "Rodents", ContentHTML: "Mice and rats. The gopher is mentioned once."},
+		{Url: "/c", ContentTitle: "Fish", ContentHTML: "Nothing to see here &lt;gopher&gt;"},
+		{Url: "/d", ContentTitle: "Birds", ContentHTML: "No hits"},
+		{Url: "/e", ContentTitle: "Members", ContentHTML: "The secret gopher", RequiresLogin: true},
+	}
+	se := NewSearchEngine(pc)
+
+	results := se.Search("Gopher")
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, without the page that requires login, got %d", len(results))
+	}
+	if results[0].URL != "/a" {
+		t.Error("a hit in the title should rank highest")
+	}
+	if !strings.Contains(results[0].Snippet, "<mark>gopher</mark>") {
+		t.Error("the search term should be highlighted: " + results[0].Snippet)
+	}
+	if !strings.Contains(results[2].Snippet, "&lt;<mark>gopher</mark>&gt;") {
+		t.Error("the snippet should be escaped: " + results[2].Snippet)
+	}
+
+	if results = se.Search("gopher rodents"); results[0].URL != "/b" {
+		t.Error("the page with all the terms should rank highest")
+	}
+}
+
+func TestSearchPagination(t *testing.T) {
+	var pc PageCollection
+	for i := 0; i < 25; i++ {
+		pc = append(pc, ContentPage{Url: "/p" + strconv.Itoa(i), ContentTitle: "Page " + strconv.Itoa(i), ContentHTML: "searchable"})
+	}
+	state := newMemUserState()
+	r := mux.NewRouter()
+	se := ServeSearch(r, testBaseCP, state, pc, testTVGF())
+
+	body := do(r, "GET", "/search?q=searchable&p=3", nil).Body.String()
+	if !strings.Contains(body, "Showing 21-25 of 25") || !strings.Contains(body, "Page 3 of 3") {
+		t.Error("expected the third page of results")
+	}
+	if strings.Contains(body, ">Next<") || !strings.Contains(body, "p=2\">Previous") {
+		t.Error("wrong links to the other pages")
+	}
+
+	se.ResultsPerPage = 0
+	if body := do(r, "GET", "/search?q=searchable", nil).Body.String(); !strings.Contains(body, "Showing 1-10 of 25") {
+		t.Error("expected the default number of results per page")
+	}
+}
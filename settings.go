@@ -0,0 +1,261 @@
+package genericsite
+
+// Settings for how the site looks, chosen by each logged-in user
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/xyproto/onthefly"
+	"github.com/xyproto/pinterface"
+	"github.com/xyproto/webhandle"
+)
+
+const (
+	// Field names in the Users() hash map
+	themeField       = "theme"
+	colorSchemeField = "colorscheme"
+	fontSizeField    = "fontsize"
+
+	// Template values for the settings of the logged-in user
+	userStyleSheetKey  = "userstylesheet"
+	userColorSchemeKey = "usercolorscheme"
+)
+
+type (
+	// How the site looks for a user. Empty values are the defaults of the site.
+	UserSettings struct {
+		Theme       string // the name of a theme
+		ColorScheme string // "light" or "dark", or empty for following the browser
+		FontSize    string // "small", "large" or "larger"
+	}
+
+	// Serves the settings page, for logged-in users
+	SettingsEngine struct {
+		state pinterface.IUserState
+	}
+)
+
+var (
+	// The font sizes that can be chosen, as a percentage of the default size
+	fontSizes = map[string]string{
+		"small":  "87.5%",
+		"large":  "112.5%",
+		"larger": "125%",
+	}
+)
+
+// Create a new engine for the settings page
+func NewSettingsEngine(userState pinterface.IUserState) *SettingsEngine {
+	return &SettingsEngine{userState}
+}
+
+// Serve the settings page at /settings, wrapped in the given base content page
+func ServeSettings(r *mux.Router, basecp BaseCP, userState pinterface.IUserState, tvgf TemplateValueGeneratorFactory) *SettingsEngine {
+	se := NewSettingsEngine(userState)
+	se.ServePages(r, basecp, tvgf)
+	return se
+}
+
+// Register the settings page with the router
+func (se *SettingsEngine) ServePages(r *mux.Router, basecp BaseCP, tvgf TemplateValueGeneratorFactory) {
+	cp := basecp(se.state)
+	cp.ContentTitle = "Settings"
+	cp.Url = "/settings"
+	r.HandleFunc("/settings", cp.WrapSimpleContextHandle(r, se.settings, tvgf(se.state)))
+}
+
+// The pages the settings engine serves, for the sitemap
+func (se *SettingsEngine) SitemapEntries() []*SitemapEntry {
+	return []*SitemapEntry{
+		{Loc: "/settings", RequiresLogin: true},
+	}
+}
+
+// Check that the settings are among the ones that can be chosen
+func (us *UserSettings) Validate() error {
+	if us.Theme != "" {
+		if _, err := GetTheme(us.Theme); err != nil {
+			return err
+		}
+	}
+	switch us.ColorScheme {
+	case "", "light", "dark":
+	default:
+		return errors.New("no such color scheme: " + us.ColorScheme)
+	}
+	if _, ok := fontSizes[us.FontSize]; !ok && us.FontSize != "" {
+		return errors.New("no such font size: " + us.FontSize)
+	}
+	return nil
+}
+
+// The settings of a user. Settings that are no longer valid, like removed themes, are not used.
+func GetUserSettings(state pinterface.IUserState, username string) *UserSettings {
+	users := state.Users()
+	us := &UserSettings{}
+	us.Theme, _ = users.Get(username, themeField)
+	us.ColorScheme, _ = users.Get(username, colorSchemeField)
+	us.FontSize, _ = users.Get(username, fontSizeField)
+	if (&UserSettings{Theme: us.Theme}).Validate() != nil {
+		us.Theme = ""
+	}
+	if (&UserSettings{ColorScheme: us.ColorScheme}).Validate() != nil {
+		us.ColorScheme = ""
+	}
+	if (&UserSettings{FontSize: us.FontSize}).Validate() != nil {
+		us.FontSize = ""
+	}
+	return us
+}
+
+// Store the settings of a user
+func SetUserSettings(state pinterface.IUserState, username string, us *UserSettings) error {
+	if err := us.Validate(); err != nil {
+		return err
+	}
+	users := state.Users()
+	for _, field := range []struct{ name, value string }{{themeField, us.Theme}, {colorSchemeField, us.ColorScheme}, {fontSizeField, us.FontSize}} {
+		if err := users.Set(username, field.name, field.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The settings of the logged-in user, or nil if no user is logged in
+func loggedInSettings(state pinterface.IUserState, req *http.Request) *UserSettings {
+	if state == nil || !state.UserRights(req) {
+		return nil
+	}
+	return GetUserSettings(state, state.Username(req))
+}
+
+// CSS that changes the look of the site to the one in the settings.
+// The colors of the site are used if no theme has been chosen.
+func (us *UserSettings) CSS() string {
+	var buf bytes.Buffer
+	if t, err := GetTheme(us.Theme); err == nil {
+		// Override the colors of the site, also when it prefers the dark variant of its own colors
+		buf.WriteString(colorSchemeCSS(&t.ColorScheme, ":root, :root[data-theme], :root:not([data-theme])"))
+	}
+	if us.ColorScheme != "" {
+		// The color scheme has been chosen once and for all
+		buf.WriteString("#colorschemetoggle {\ndisplay: none;\n}\n")
+	}
+	if size, ok := fontSizes[us.FontSize]; ok {
+		buf.WriteString("body {\nfont-size: " + size + ";\n}\n")
+	}
+	return buf.String()
+}
+
+// The URL of the stylesheet for the settings, or an empty string if the settings do not change the look of the site.
+// The stylesheets are stored by the hash of the CSS, so a theme that is registered again only adds a stylesheet if it looks different.
+func (us *UserSettings) StyleSheet() string {
+	css := us.CSS()
+	if css == "" {
+		return ""
+	}
+	return styleSheets.Add(css)
+}
+
+// Add the settings of the logged-in user to the template values,
+// so that every page looks the way the user has chosen
+func UserSettingsValues(state pinterface.IUserState, tvg webhandle.TemplateValueGenerator) webhandle.TemplateValueGenerator {
+	if state == nil {
+		return tvg
+	}
+	return func(w http.ResponseWriter, req *http.Request) onthefly.TemplateValues {
+		values := tvg(w, req)
+		us := loggedInSettings(state, req)
+		if us == nil {
+			return values
+		}
+		tv := make(onthefly.TemplateValues, len(values)+2)
+		for key, value := range values {
+			tv[key] = value
+		}
+		if url := us.StyleSheet(); url != "" {
+			tv[userStyleSheetKey] = "<link rel=\"stylesheet\" href=\"" + url + "\">"
+		}
+		tv[userColorSchemeKey] = us.ColorScheme
+		return tv
+	}
+}
+
+// Add the placeholders for the settings of the logged-in user to a page
+func addUserSettings(page *onthefly.Page) error {
+	root, err := page.GetTag("html")
+	if err != nil {
+		return err
+	}
+	root.AddAttrib("data-theme", "{{"+userColorSchemeKey+"}}")
+	head, err := page.GetTag("head")
+	if err != nil {
+		return err
+	}
+	// Loaded after the other stylesheets, so that it takes precedence
+	head.AddLastContent("{{{" + userStyleSheetKey + "}}}")
+	return nil
+}
+
+// A select box where one of the options is selected
+func selectField(label, name, selected string, options ...string) string {
+	var buf bytes.Buffer
+	buf.WriteString("<div class=\"formfield\"><label for=\"" + name + "\" style=\"display: inline-block; width: 10em;\">" + label + "</label><select id=\"" + name + "\" name=\"" + name + "\">")
+	// Every other string is the value and the text of an option
+	for i := 0; i+1 < len(options); i += 2 {
+		buf.WriteString("<option value=\"" + html.EscapeString(options[i]) + "\"")
+		if options[i] == selected {
+			buf.WriteString(" selected")
+		}
+		buf.WriteString(">" + html.EscapeString(options[i+1]) + "</option>")
+	}
+	buf.WriteString("</select></div>")
+	return buf.String()
+}
+
+// Settings form, posts "theme", "colorscheme" and "fontsize" to /settings.
+// csrfField is the hidden field with the token of the user, from CSRFField.
+func SettingsForm(us *UserSettings, csrfField string) string {
+	themeOptions := []string{"", "The default for this site"}
+	for _, name := range ThemeNames() {
+		themeOptions = append(themeOptions, name, strings.Title(name))
+	}
+	return form("settingsForm", "/settings", "Save",
+		csrfField,
+		selectField("Theme:", themeField, us.Theme, themeOptions...),
+		selectField("Colors:", colorSchemeField, us.ColorScheme, "", "The same as the browser", "light", "Light", "dark", "Dark"),
+		selectField("Font size:", fontSizeField, us.FontSize, "small", "Small", "", "Normal", "large", "Large", "larger", "Larger"))
+}
+
+// Show the settings of the logged-in user, or store the posted settings
+func (se *SettingsEngine) settings(w http.ResponseWriter, req *http.Request) string {
+	if !se.state.UserRights(req) {
+		w.WriteHeader(http.StatusForbidden)
+		return "Please <a href=\"/login\">log in</a> to change the settings."
+	}
+	username := se.state.Username(req)
+	csrfField := CSRFField(se.state, req)
+	if req.Method != "POST" {
+		return SettingsForm(GetUserSettings(se.state, username), csrfField)
+	}
+	if !ValidCSRF(se.state, req) {
+		w.WriteHeader(http.StatusForbidden)
+		return MessageAndForm(csrfMessage, SettingsForm(GetUserSettings(se.state, username), csrfField))
+	}
+	us := &UserSettings{
+		Theme:       string(UserInput(webhandle.GetFormParam(req, themeField))),
+		ColorScheme: string(UserInput(webhandle.GetFormParam(req, colorSchemeField))),
+		FontSize:    string(UserInput(webhandle.GetFormParam(req, fontSizeField))),
+	}
+	if err := SetUserSettings(se.state, username, us); err != nil {
+		return MessageAndForm("Could not save the settings: "+html.EscapeString(err.Error())+".", SettingsForm(GetUserSettings(se.state, username), csrfField))
+	}
+	// Reload, so that the page is shown with the new settings
+	return "The settings have been saved." + onthefly.JS(onthefly.Redirect("/settings"))
+}
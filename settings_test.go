@@ -0,0 +1,99 @@
+package genericsite
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestUserSettings(t *testing.T) {
+	state := newMemUserState()
+	r := mux.NewRouter()
+	ServeSettings(r, testBaseCP, state, testTVGF())
+	PublishCPs(r, state, PageCollection{*testBaseCP(state)}, testBaseCP(state).ColorScheme, testTVGF(), "/css/menu.css")
+
+	state.AddUser("bob", "hunter22", "bob@example.com")
+	state.MarkConfirmed("bob")
+	state.SetLoggedIn("bob")
+	bob := &http.Cookie{Name: "user", Value: "bob"}
+
+	if w := do(r, "GET", "/settings", nil); w.Code != http.StatusForbidden {
+		t.Error("the settings should only be available for logged-in users")
+	}
+	if w := do(r, "GET", "/settings", nil, bob); !strings.Contains(w.Body.String(), "settingsForm") || !strings.Contains(w.Body.String(), "<option value=\"solarized\">") {
+		t.Fatal("expected a form with the available themes: " + w.Body.String())
+	}
+
+	if w := do(r, "POST", "/settings", url.Values{"theme": {"solarized"}}, bob); w.Code != http.StatusForbidden || GetUserSettings(state, "bob").Theme != "" {
+		t.Error("the settings should not be saved without the form token")
+	}
+
+	w := do(r, "POST", "/settings", withCSRF(state, "bob", url.Values{"theme": {"nonexisting"}, "colorscheme": {"dark"}}), bob)
+	if !strings.Contains(w.Body.String(), "no such theme") || GetUserSettings(state, "bob").ColorScheme != "" {
+		t.Error("invalid settings should not be saved: " + w.Body.String())
+	}
+
+	do(r, "POST", "/settings", withCSRF(state, "bob", url.Values{"theme": {"solarized"}, "colorscheme": {"dark"}, "fontsize": {"large"}}), bob)
+	if us := GetUserSettings(state, "bob"); *us != (UserSettings{"solarized", "dark", "large"}) {
+		t.Fatalf("unexpected settings: %+v", us)
+	}
+
+	// Every page looks the way bob has chosen
+	page := do(r, "GET", "/", nil, bob).Body.String()
+	if !strings.Contains(page, "data-theme=\"dark\"") {
+		t.Error("expected the chosen color scheme")
+	}
+	link := regexp.MustCompile(`<link rel="stylesheet" href="(/css/gen/[0-9a-f]+\.css)">`).FindStringSubmatch(page)
+	if link == nil {
+		t.Fatal("expected a link to the stylesheet for the settings: " + page)
+	}
+	css := do(r, "GET", link[1], nil).Body.String()
+	for _, s := range []string{"font-size: 112.5%;", "--content-background: #073642;", "#colorschemetoggle {\ndisplay: none;"} {
+		if !strings.Contains(css, s) {
+			t.Errorf("expected %q in the stylesheet for the settings:\n%s", s, css)
+		}
+	}
+
+	// Other users see the site as it is
+	page = do(r, "GET", "/", nil).Body.String()
+	if strings.Contains(page, link[1]) || !strings.Contains(page, "data-theme=\"\"") {
+		t.Error("the settings of bob should not be used for others")
+	}
+	// The settings are only in their own stylesheet, so the menu CSS can be cached for everyone
+	withSettings := do(r, "GET", "/css/menu.css", nil, bob)
+	without := do(r, "GET", "/css/menu.css", nil)
+	if strings.Contains(withSettings.Body.String(), "font-size: 112.5%;") || withSettings.Header().Get("ETag") != without.Header().Get("ETag") || withSettings.Header().Get("Cache-Control") != shortCacheControl {
+		t.Error("the menu CSS should be the same for every user")
+	}
+}
+
+func TestReregisteredThemeStyleSheet(t *testing.T) {
+	solarized, err := GetTheme("solarized")
+	if err != nil {
+		t.Fatal(err)
+	}
+	theme := *solarized
+	theme.Name = "reregistered"
+	if err := RegisterTheme(&theme); err != nil {
+		t.Fatal(err)
+	}
+	us := &UserSettings{Theme: "reregistered"}
+	before := us.StyleSheet()
+
+	changed := theme
+	changed.ColorScheme.Content_background = "#123456"
+	if err := RegisterTheme(&changed); err != nil {
+		t.Fatal(err)
+	}
+	after := us.StyleSheet()
+	if css, ok := styleSheets.Get(after); before == after || !ok || !strings.Contains(css, "#123456") {
+		t.Error("expected a new stylesheet for a theme that has been registered again with other colors")
+	}
+	if RegisterTheme(&theme); us.StyleSheet() != before {
+		t.Error("expected the same stylesheet for a theme with the same colors")
+	}
+}
@@ -0,0 +1,266 @@
+package genericsite
+
+// Sitemaps, as described at https://www.sitemaps.org/protocol.html
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// The maximum number of URLs in one sitemap
+	maxSitemapURLs = 50000
+
+	sitemapNamespace = "http://www.sitemaps.org/schemas/sitemap/0.9"
+)
+
+type (
+	// A page in the sitemap
+	SitemapEntry struct {
+		Loc           string // an absolute URL, or a path like "/about"
+		LastModified  time.Time
+		ChangeFreq    string  // "always", "hourly", "daily", "weekly", "monthly", "yearly" or "never"
+		Priority      float64 // from 0.0 to 1.0, 0 is not included in the sitemap
+		RequiresLogin bool
+	}
+
+	// Engines that serve pages can list them for the sitemap
+	SitemapLister interface {
+		SitemapEntries() []*SitemapEntry
+	}
+
+	// A list of pages that can be served as sitemaps
+	Sitemap struct {
+		mut               sync.RWMutex
+		entries           []*SitemapEntry
+		excludeLoginPages bool
+	}
+
+	xmlURL struct {
+		Loc        string `xml:"loc"`
+		LastMod    string `xml:"lastmod,omitempty"`
+		ChangeFreq string `xml:"changefreq,omitempty"`
+		Priority   string `xml:"priority,omitempty"`
+	}
+
+	xmlURLSet struct {
+		XMLName xml.Name `xml:"urlset"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		URLs    []xmlURL `xml:"url"`
+	}
+
+	xmlSitemap struct {
+		Loc     string `xml:"loc"`
+		LastMod string `xml:"lastmod,omitempty"`
+	}
+
+	xmlSitemapIndex struct {
+		XMLName  xml.Name     `xml:"sitemapindex"`
+		Xmlns    string       `xml:"xmlns,attr"`
+		Sitemaps []xmlSitemap `xml:"sitemap"`
+	}
+)
+
+// Create an empty sitemap. Pages that require login are excluded by default.
+func NewSitemap() *Sitemap {
+	return &Sitemap{excludeLoginPages: true}
+}
+
+// Choose if pages that require login should be left out of the sitemap
+func (sm *Sitemap) SetExcludeLoginPages(exclude bool) {
+	sm.mut.Lock()
+	sm.excludeLoginPages = exclude
+	sm.mut.Unlock()
+}
+
+// Add a page to the sitemap
+func (sm *Sitemap) Add(entry *SitemapEntry) {
+	sm.mut.Lock()
+	sm.entries = append(sm.entries, entry)
+	sm.mut.Unlock()
+}
+
+// Add a content page to the sitemap
+func (sm *Sitemap) AddPage(cp *ContentPage) {
+	sm.Add(&SitemapEntry{cp.Url, cp.LastModified, cp.ChangeFreq, cp.Priority, cp.RequiresLogin})
+}
+
+// Add all the content pages to the sitemap
+func (sm *Sitemap) AddPages(pc PageCollection) {
+	for i := range pc {
+		sm.AddPage(&pc[i])
+	}
+}
+
+// Add all the pages an engine serves to the sitemap
+func (sm *Sitemap) AddEngine(engine SitemapLister) {
+	for _, entry := range engine.SitemapEntries() {
+		sm.Add(entry)
+	}
+}
+
+// All pages in the sitemap, except the pages that require login, if they are excluded
+func (sm *Sitemap) Entries() []*SitemapEntry {
+	sm.mut.RLock()
+	defer sm.mut.RUnlock()
+	var entries []*SitemapEntry
+	for _, entry := range sm.entries {
+		if entry.RequiresLogin && sm.excludeLoginPages {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// All pages in the sitemap, including the ones that require login
+func (sm *Sitemap) AllEntries() []*SitemapEntry {
+	sm.mut.RLock()
+	defer sm.mut.RUnlock()
+	return append([]*SitemapEntry{}, sm.entries...)
+}
+
+// Make the location absolute, if it is a path
+func absoluteURL(baseURL, loc string) string {
+	if strings.HasPrefix(loc, "http://") || strings.HasPrefix(loc, "https://") {
+		return loc
+	}
+	return baseURL + loc
+}
+
+// Format a time as a W3C Datetime, or an empty string for the zero time
+func w3cTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// The number of sitemap files that are needed for all the pages
+func (sm *Sitemap) Parts() int {
+	n := len(sm.Entries())
+	if n == 0 {
+		return 1
+	}
+	return (n + maxSitemapURLs - 1) / maxSitemapURLs
+}
+
+// The pages in the given part of the sitemap, counting from 1
+func (sm *Sitemap) part(entries []*SitemapEntry, part int) []*SitemapEntry {
+	first := (part - 1) * maxSitemapURLs
+	if part < 1 || first >= len(entries) {
+		return nil
+	}
+	last := first + maxSitemapURLs
+	if last > len(entries) {
+		last = len(entries)
+	}
+	return entries[first:last]
+}
+
+// Generate the XML for the given part of the sitemap, counting from 1
+func (sm *Sitemap) URLSet(baseURL string, part int) ([]byte, error) {
+	urlset := xmlURLSet{Xmlns: sitemapNamespace}
+	for _, entry := range sm.part(sm.Entries(), part) {
+		u := xmlURL{Loc: absoluteURL(baseURL, entry.Loc), LastMod: w3cTime(entry.LastModified), ChangeFreq: entry.ChangeFreq}
+		if entry.Priority > 0 {
+			u.Priority = strconv.FormatFloat(entry.Priority, 'f', 1, 64)
+		}
+		urlset.URLs = append(urlset.URLs, u)
+	}
+	return marshalXML(urlset)
+}
+
+// Generate the XML for the sitemap index, that lists all parts of the sitemap
+func (sm *Sitemap) Index(baseURL string) ([]byte, error) {
+	index := xmlSitemapIndex{Xmlns: sitemapNamespace}
+	entries := sm.Entries()
+	for part := 1; part <= sm.Parts(); part++ {
+		// The last modification of a part is the last modification of any of its pages
+		var lastMod time.Time
+		for _, entry := range sm.part(entries, part) {
+			if entry.LastModified.After(lastMod) {
+				lastMod = entry.LastModified
+			}
+		}
+		index.Sitemaps = append(index.Sitemaps, xmlSitemap{baseURL + "/sitemap" + strconv.Itoa(part) + ".xml", w3cTime(lastMod)})
+	}
+	return marshalXML(index)
+}
+
+func marshalXML(v interface{}) ([]byte, error) {
+	data, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// Write XML, or an error
+func serveXML(w http.ResponseWriter, req *http.Request, data []byte, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	serveGenerated(w, req, data, "application/xml; charset=utf-8", documentCacheControl, time.Time{})
+}
+
+// Serve the sitemap at /sitemap.xml, the sitemap index at /sitemap_index.xml
+// and the parts of the sitemap at /sitemap1.xml, /sitemap2.xml etc.
+// /sitemap.xml is the sitemap index if there are more than 50000 pages.
+// The URLs start with the site URL from SetSiteURL, and only with the Host of the request if it is not set.
+func (sm *Sitemap) ServePages(r *mux.Router) {
+	r.HandleFunc("/sitemap.xml", func(w http.ResponseWriter, req *http.Request) {
+		if sm.Parts() > 1 {
+			data, err := sm.Index(BaseURL(req))
+			serveXML(w, req, data, err)
+			return
+		}
+		data, err := sm.URLSet(BaseURL(req), 1)
+		serveXML(w, req, data, err)
+	})
+	r.HandleFunc("/sitemap_index.xml", func(w http.ResponseWriter, req *http.Request) {
+		data, err := sm.Index(BaseURL(req))
+		serveXML(w, req, data, err)
+	})
+	r.HandleFunc("/sitemap{part:[0-9]+}.xml", func(w http.ResponseWriter, req *http.Request) {
+		part, err := strconv.Atoi(mux.Vars(req)["part"])
+		if err != nil || part < 1 || part > sm.Parts() {
+			http.NotFound(w, req)
+			return
+		}
+		data, err := sm.URLSet(BaseURL(req), part)
+		serveXML(w, req, data, err)
+	})
+}
+
+// The pages the user engine serves, for the sitemap
+func (ue *UserEngine) SitemapEntries() []*SitemapEntry {
+	return []*SitemapEntry{
+		{Loc: "/login"},
+		{Loc: "/register"},
+		{Loc: "/forgot-password"},
+		{Loc: "/forgot-username"},
+		{Loc: "/logout", RequiresLogin: true},
+	}
+}
+
+// The pages the admin engine serves, for the sitemap
+func (ae *AdminEngine) SitemapEntries() []*SitemapEntry {
+	return []*SitemapEntry{
+		{Loc: "/admin", RequiresLogin: true},
+	}
+}
+
+// The pages the mail queue serves, for the sitemap
+func (mq *MailQueue) SitemapEntries() []*SitemapEntry {
+	return []*SitemapEntry{
+		{Loc: "/admin/mail", RequiresLogin: true},
+	}
+}
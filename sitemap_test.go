@@ -0,0 +1,75 @@
+package genericsite
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestSitemap(t *testing.T) {
+	modified := time.Date(2020, 5, 17, 12, 0, 0, 0, time.UTC)
+	pc := PageCollection{
+		{Url: "/", LastModified: modified, ChangeFreq: "weekly", Priority: 1},
+		{Url: "/secret", RequiresLogin: true},
+	}
+	sm := NewSitemap()
+	sm.AddPages(pc)
+	sm.AddEngine(NewUserEngine(newMemUserState()))
+	r := mux.NewRouter()
+	sm.ServePages(r)
+
+	rec := do(r, "GET", "/sitemap.xml", nil)
+	body := rec.Body.String()
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "application/xml") {
+		t.Error("wrong content type: " + rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(body, "<url>\n    <loc>http://example.com/</loc>\n    <lastmod>2020-05-17T12:00:00Z</lastmod>\n    <changefreq>weekly</changefreq>\n    <priority>1.0</priority>\n  </url>") {
+		t.Error("expected the front page with metadata:\n" + body)
+	}
+	if !strings.Contains(body, "<loc>http://example.com/login</loc>") {
+		t.Error("expected the pages of the user engine")
+	}
+	if strings.Contains(body, "/secret") || strings.Contains(body, "/logout") {
+		t.Error("pages that require login should be excluded")
+	}
+
+	sm.SetExcludeLoginPages(false)
+	if body = do(r, "GET", "/sitemap1.xml", nil).Body.String(); !strings.Contains(body, "/secret") {
+		t.Error("pages that require login should be included")
+	}
+	if do(r, "GET", "/sitemap2.xml", nil).Code != 404 {
+		t.Error("there should only be one part")
+	}
+
+	// The Host header is chosen by the client, the site URL is not
+	SetSiteURL("https://example.org")
+	defer SetSiteURL("")
+	if body = do(r, "GET", "http://attacker.example/sitemap.xml", nil).Body.String(); !strings.Contains(body, "<loc>https://example.org/</loc>") || strings.Contains(body, "attacker.example") {
+		t.Error("expected the site URL in the sitemap:\n" + body)
+	}
+}
+
+func TestSitemapIndex(t *testing.T) {
+	sm := NewSitemap()
+	for i := 0; i < maxSitemapURLs+1; i++ {
+		sm.Add(&SitemapEntry{Loc: "/p" + strconv.Itoa(i)})
+	}
+	sm.Add(&SitemapEntry{Loc: "/last", LastModified: time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)})
+	r := mux.NewRouter()
+	sm.ServePages(r)
+
+	if sm.Parts() != 2 {
+		t.Fatalf("expected 2 parts, got %d", sm.Parts())
+	}
+	index := do(r, "GET", "/sitemap.xml", nil).Body.String()
+	if !strings.Contains(index, "<sitemapindex") || !strings.Contains(index, "<loc>http://example.com/sitemap2.xml</loc>\n    <lastmod>2021-01-02T03:04:05Z</lastmod>") {
+		t.Error("expected a sitemap index:\n" + index)
+	}
+	part2 := do(r, "GET", "/sitemap2.xml", nil).Body.String()
+	if strings.Count(part2, "<url>") != 2 || !strings.Contains(part2, "/last") {
+		t.Error("expected the last two pages in the second part")
+	}
+}
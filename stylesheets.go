@@ -0,0 +1,121 @@
+package genericsite
+
+// Generated stylesheets, addressed by the hash of their contents
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultStyleSheetPrefix = "/css/gen/"
+
+	// Characters of the content hash that are used in the URL
+	styleSheetHashLength = 16
+)
+
+type (
+	// Stylesheets by the hash of their contents. Pages that look the same share the same stylesheet.
+	StyleSheets struct {
+		Prefix  string // the URLs of the stylesheets start with this
+		mut     sync.RWMutex
+		sheets  map[string]*styleSheet
+		routers map[*mux.Router]bool
+	}
+
+	styleSheet struct {
+		css      string
+		added    time.Time
+		variants *variants
+	}
+)
+
+// All generated stylesheets of the published pages
+var styleSheets = NewStyleSheets()
+
+// Create an empty collection of stylesheets, served below /css/gen/
+func NewStyleSheets() *StyleSheets {
+	return &StyleSheets{Prefix: defaultStyleSheetPrefix, sheets: make(map[string]*styleSheet), routers: make(map[*mux.Router]bool)}
+}
+
+// The declarations of CSS generated by onthefly come in random order.
+// Sort each run of declarations, so that the same style always gives the same CSS.
+func CanonicalCSS(css string) string {
+	lines := strings.Split(css, "\n")
+	isDeclaration := func(line string) bool {
+		return strings.HasSuffix(line, ";") && !strings.Contains(line, "{")
+	}
+	for i := 0; i < len(lines); {
+		if !isDeclaration(lines[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(lines) && isDeclaration(lines[j]) {
+			j++
+		}
+		sort.Strings(lines[i:j])
+		i = j
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Add a stylesheet and return the URL it is served at
+func (ss *StyleSheets) Add(css string) string {
+	sum := sha256.Sum256([]byte(css))
+	hash := hex.EncodeToString(sum[:])[:styleSheetHashLength]
+	ss.mut.Lock()
+	if _, ok := ss.sheets[hash]; !ok {
+		data := []byte(css)
+		ss.sheets[hash] = &styleSheet{css, time.Now(), precompressed(data, contentETag(data))}
+	}
+	ss.mut.Unlock()
+	return ss.Prefix + hash + ".css"
+}
+
+// The stylesheet at the given URL, together with when it was added
+func (ss *StyleSheets) get(url string) (*styleSheet, bool) {
+	if !strings.HasPrefix(url, ss.Prefix) || !strings.HasSuffix(url, ".css") {
+		return nil, false
+	}
+	hash := strings.TrimSuffix(strings.TrimPrefix(url, ss.Prefix), ".css")
+	ss.mut.RLock()
+	defer ss.mut.RUnlock()
+	sheet, ok := ss.sheets[hash]
+	return sheet, ok
+}
+
+// Find a stylesheet by the URL it is served at
+func (ss *StyleSheets) Get(url string) (string, bool) {
+	if sheet, ok := ss.get(url); ok {
+		return sheet.css, true
+	}
+	return "", false
+}
+
+// Serve all stylesheets, both the current and the ones that are added later.
+// Only registers the handler the first time it is called for a router.
+func (ss *StyleSheets) ServePages(r *mux.Router) {
+	ss.mut.Lock()
+	defer ss.mut.Unlock()
+	if ss.routers[r] {
+		return
+	}
+	ss.routers[r] = true
+	r.PathPrefix(ss.Prefix).HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		sheet, ok := ss.get(req.URL.Path)
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		// The contents of a URL never change
+		serveVariants(w, req, sheet.variants, cssContentType, farFutureCacheControl, sheet.added)
+	})
+}
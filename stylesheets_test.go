@@ -0,0 +1,114 @@
+package genericsite
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestCanonicalCSS(t *testing.T) {
+	a := CanonicalCSS("#a {\n  color: red;\n  margin: 0;\n}\n\n#b {\n  z-index: 1;\n  border: 0;\n}\n")
+	b := CanonicalCSS("#a {\n  margin: 0;\n  color: red;\n}\n\n#b {\n  border: 0;\n  z-index: 1;\n}\n")
+	if a != b || !strings.HasPrefix(a, "#a {\n  color: red;\n  margin: 0;\n}\n\n#b {\n  border: 0;") {
+		t.Error("expected the same CSS, with the declarations sorted within each block:\n" + a)
+	}
+	cp := DefaultCP(nil)
+	if CanonicalCSS(genericPageBuilder(cp).GetCSS()) != CanonicalCSS(genericPageBuilder(cp).GetCSS()) {
+		t.Error("the same page should give the same CSS")
+	}
+}
+
+func TestPerPageCSS(t *testing.T) {
+	red := *DefaultCP(nil).ColorScheme
+	red.Darkgray = "#ff0000"
+	red.Default_background = "#300000"
+	pc := PageCollection{*DefaultCP(nil), *DefaultCP(nil), *DefaultCP(nil), *DefaultCP(nil)}
+	pc[0].Url = "/blue"
+	pc[1].Url = "/red"
+	pc[1].ColorScheme = &red
+	pc[2].Url = "/stretched"
+	pc[2].StretchBackground = true
+	pc[3].Url = "/blue2"
+
+	r := mux.NewRouter()
+	PublishCPs(r, newMemUserState(), pc, DefaultCP(nil).ColorScheme, testTVGF(), "/css/menu.css")
+
+	css := func(page, which string) string {
+		body := do(r, "GET", page, nil).Body.String()
+		for _, line := range strings.Split(body, "\n") {
+			if strings.Contains(line, "stylesheet") && strings.Contains(line, "/css/gen/") {
+				start := strings.Index(line, "/css/gen/")
+				url := line[start : start+strings.Index(line[start:], "\"")]
+				sheet := do(r, "GET", url, nil).Body.String()
+				if strings.Contains(sheet, which) {
+					return sheet
+				}
+			}
+		}
+		t.Fatalf("no stylesheet containing %q for %s", which, page)
+		return ""
+	}
+	if !strings.Contains(css("/red", "#topbox"), "#ff0000") || strings.Contains(css("/blue", "#topbox"), "#ff0000") {
+		t.Error("the pages should have their own colors")
+	}
+	if !strings.Contains(css("/red", ".menuEntry"), "#300000") || strings.Contains(css("/blue", ".menuEntry"), "#300000") {
+		t.Error("the menus should have their own colors")
+	}
+	if !strings.Contains(css("/stretched", ".menuEntry"), "background-size: cover") || strings.Contains(css("/blue", ".menuEntry"), "background-size: cover") {
+		t.Error("only the stretched page should have a stretched background")
+	}
+	if css("/blue", "#topbox") != css("/blue2", "#topbox") {
+		t.Error("pages that look the same should share the stylesheet")
+	}
+}
+
+func TestWrapSimpleContextHandle(t *testing.T) {
+	countRoutes := func(r *mux.Router) int {
+		n := 0
+		r.Walk(func(*mux.Route, *mux.Router, []*mux.Route) error {
+			n++
+			return nil
+		})
+		return n
+	}
+	r := mux.NewRouter()
+	cp := DefaultCP(nil)
+	r.HandleFunc("/hello", cp.WrapSimpleContextHandle(r, func(w http.ResponseWriter, req *http.Request) string {
+		return "Hello " + req.URL.Query().Get("name")
+	}, testTVGF()(newMemUserState())))
+	routes := countRoutes(r)
+
+	// Concurrent requests must neither race nor register routes
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := strconv.Itoa(i)
+			if body := do(r, "GET", "/hello?name="+name, nil).Body.String(); !strings.Contains(body, "Hello "+name+"<") {
+				t.Error("expected the contents for request " + name)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if countRoutes(r) != routes {
+		t.Error("no routes should be registered while serving requests")
+	}
+	if cp.ContentHTML != "NOP NOP NOP" || cp.GeneratedCSSurl != "/css/style.css" {
+		t.Error("the wrapped page should not be modified")
+	}
+
+	body := do(r, "GET", "/hello", nil).Body.String()
+	start := strings.Index(body, "/css/gen/")
+	if start < 0 {
+		t.Fatal("expected a link to the generated CSS")
+	}
+	url := body[start : start+strings.Index(body[start:], "\"")]
+	if css := do(r, "GET", url, nil).Body.String(); !strings.Contains(css, "#topbox") {
+		t.Error("expected the generated CSS at " + url)
+	}
+}
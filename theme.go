@@ -0,0 +1,308 @@
+package genericsite
+
+// Themes, that can be loaded from JSON or TOML files and selected by name
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	"github.com/xyproto/pinterface"
+)
+
+// The look of a site. Fields that are not given in a theme file are taken from the default theme.
+type Theme struct {
+	Name                     string      `json:"name"`
+	ColorScheme              ColorScheme `json:"colors"`
+	BgImageURL               string      `json:"background_image"`
+	StretchBackground        bool        `json:"stretch_background"`
+	BackgroundTextureURL     string      `json:"background_texture"`
+	DarkBackgroundTextureURL string      `json:"dark_background_texture"`
+	FooterColor              string      `json:"footer_color"`
+	FooterTextColor          string      `json:"footer_text_color"`
+	RoundedLook              bool        `json:"rounded"`
+	GoogleFonts              []string    `json:"google_fonts"`
+	CustomSansSerif          string      `json:"sans_serif"`
+	CustomSerif              string      `json:"serif"`
+}
+
+var (
+	themeMut sync.RWMutex
+
+	// The bundled themes and the themes that have been loaded, by name
+	themes = map[string]*Theme{}
+)
+
+func init() {
+	for _, t := range presetThemes() {
+		themes[t.Name] = t
+	}
+}
+
+// The theme of a content page
+func ThemeOf(cp *ContentPage) *Theme {
+	t := &Theme{
+		BgImageURL:               cp.BgImageURL,
+		StretchBackground:        cp.StretchBackground,
+		BackgroundTextureURL:     cp.BackgroundTextureURL,
+		DarkBackgroundTextureURL: cp.DarkBackgroundTextureURL,
+		FooterColor:              cp.FooterColor,
+		FooterTextColor:          cp.FooterTextColor,
+		RoundedLook:              cp.RoundedLook,
+		GoogleFonts:              append([]string{}, cp.GoogleFonts...),
+		CustomSansSerif:          cp.CustomSansSerif,
+		CustomSerif:              cp.CustomSerif,
+	}
+	if cp.ColorScheme != nil {
+		t.ColorScheme = cp.ColorScheme.copy()
+	}
+	return t
+}
+
+// A copy of the color scheme, that does not share the dark variant
+func (cs *ColorScheme) copy() ColorScheme {
+	c := *cs
+	if c.Dark != nil {
+		dark := *c.Dark
+		c.Dark = &dark
+	}
+	return c
+}
+
+// The look of DefaultCP
+func DefaultTheme() *Theme {
+	t := ThemeOf(DefaultCP(nil))
+	t.Name = "default"
+	return t
+}
+
+// The bundled themes
+func presetThemes() []*Theme {
+	light := DefaultTheme()
+	light.Name = "light"
+	light.ColorScheme = ColorScheme{
+		Darkgray:           "#e8e8e8",
+		Nicecolor:          "#2a5db0",
+		Menu_link:          "#404040",
+		Menu_hover:         "#2a5db0",
+		Menu_active:        "#000000",
+		Default_background: "#f8f8f8",
+		TitleText:          "#202020",
+		Content_background: "#ffffff",
+		Content_text:       "#202020",
+		Dark: &ColorScheme{
+			Darkgray:           "#181818",
+			Nicecolor:          "#80a8f0",
+			Menu_link:          "#b0b0b0",
+			Menu_hover:         "#ffffff",
+			Menu_active:        "#80a8f0",
+			Default_background: "#101010",
+			TitleText:          "#d0d0d0",
+			Content_background: "#202020",
+			Content_text:       "#e0e0e0",
+		},
+	}
+	light.DarkBackgroundTextureURL = ""
+	light.FooterColor = "#e8e8e8"
+	light.FooterTextColor = "#505050"
+
+	dark := DefaultTheme()
+	dark.Name = "dark"
+	dark.ColorScheme = ColorScheme{
+		Darkgray:           "#101010",
+		Nicecolor:          "#80a8f0",
+		Menu_link:          "#b0b0b0",
+		Menu_hover:         "#ffffff",
+		Menu_active:        "#80a8f0",
+		Default_background: "#000000",
+		TitleText:          "#d0d0d0",
+		Content_background: "rgba(24,24,32,0.92)",
+		Content_text:       "#e0e0e0",
+	}
+	dark.FooterColor = "#101010"
+	dark.FooterTextColor = "#909090"
+
+	// https://ethanschoonover.com/solarized/
+	solarized := DefaultTheme()
+	solarized.Name = "solarized"
+	solarized.ColorScheme = ColorScheme{
+		Darkgray:           "#073642",
+		Nicecolor:          "#268bd2",
+		Menu_link:          "#93a1a1",
+		Menu_hover:         "#eee8d5",
+		Menu_active:        "#fdf6e3",
+		Default_background: "#002b36",
+		TitleText:          "#839496",
+		Content_background: "#fdf6e3",
+		Content_text:       "#586e75",
+		Dark: &ColorScheme{
+			Content_background: "#073642",
+			Content_text:       "#93a1a1",
+		},
+	}
+	solarized.DarkBackgroundTextureURL = ""
+	solarized.FooterColor = "#002b36"
+	solarized.FooterTextColor = "#586e75"
+	solarized.RoundedLook = true
+
+	return []*Theme{DefaultTheme(), light, dark, solarized}
+}
+
+// Check that all colors of the theme are valid CSS colors
+func (t *Theme) Validate() error {
+	colors := append(t.ColorScheme.withDefaults().colors(), namedColor{"footer_color", t.FooterColor}, namedColor{"footer_text_color", t.FooterTextColor})
+	if dark := t.ColorScheme.darkVariant(); dark != nil {
+		for _, c := range dark.colors() {
+			colors = append(colors, namedColor{"dark." + c.name, c.value})
+		}
+	}
+	for _, c := range colors {
+		if !ValidCSSColor(c.value) {
+			return errors.New("theme " + strconv.Quote(t.Name) + ": " + c.name + " is not a valid CSS color: " + strconv.Quote(c.value))
+		}
+	}
+	return nil
+}
+
+// Use the theme for the content page
+func (t *Theme) Apply(cp *ContentPage) {
+	cs := t.ColorScheme.copy()
+	cp.ColorScheme = &cs
+	cp.BgImageURL = t.BgImageURL
+	cp.StretchBackground = t.StretchBackground
+	cp.BackgroundTextureURL = t.BackgroundTextureURL
+	cp.DarkBackgroundTextureURL = t.DarkBackgroundTextureURL
+	cp.FooterColor = t.FooterColor
+	cp.FooterTextColor = t.FooterTextColor
+	cp.RoundedLook = t.RoundedLook
+	cp.GoogleFonts = append([]string{}, t.GoogleFonts...)
+	cp.CustomSansSerif = t.CustomSansSerif
+	cp.CustomSerif = t.CustomSerif
+}
+
+// Parse a theme in JSON. The name is used if the theme does not have one.
+func ParseThemeJSON(data []byte, name string) (*Theme, error) {
+	t := DefaultTheme()
+	t.Name = name
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, errors.New("theme " + strconv.Quote(name) + ": " + err.Error())
+	}
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Parse a theme in TOML. The name is used if the theme does not have one.
+// The keys are the same as for JSON, with tables like [colors] and [colors.dark].
+func ParseThemeTOML(data []byte, name string) (*Theme, error) {
+	var m map[string]interface{}
+	if _, err := toml.Decode(string(data), &m); err != nil {
+		return nil, errors.New("theme " + strconv.Quote(name) + ": " + err.Error())
+	}
+	jsonData, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return ParseThemeJSON(jsonData, name)
+}
+
+// Load a theme from a .json or .toml file. The name of the file is used if the theme does not have a name.
+func LoadThemeFile(filename string) (*Theme, error) {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext != ".json" && ext != ".toml" {
+		return nil, errors.New(filename + ": themes must be .json or .toml files")
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	if ext == ".toml" {
+		return ParseThemeTOML(data, name)
+	}
+	return ParseThemeJSON(data, name)
+}
+
+// Make the theme available by name. A theme with the same name is replaced.
+func RegisterTheme(t *Theme) error {
+	if t.Name == "" {
+		return errors.New("a theme must have a name")
+	}
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	themeMut.Lock()
+	themes[t.Name] = t
+	themeMut.Unlock()
+	return nil
+}
+
+// Load and register all .json and .toml themes in a directory.
+// Nothing is registered if one of the themes is invalid.
+func LoadThemeDir(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var loaded []*Theme
+	for _, fi := range entries {
+		ext := strings.ToLower(filepath.Ext(fi.Name()))
+		if fi.IsDir() || (ext != ".json" && ext != ".toml") {
+			continue
+		}
+		t, err := LoadThemeFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return err
+		}
+		loaded = append(loaded, t)
+	}
+	for _, t := range loaded {
+		if err := RegisterTheme(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Find a theme by name
+func GetTheme(name string) (*Theme, error) {
+	themeMut.RLock()
+	defer themeMut.RUnlock()
+	t, ok := themes[name]
+	if !ok {
+		return nil, errors.New("no such theme: " + name)
+	}
+	return t, nil
+}
+
+// The names of all available themes, sorted
+func ThemeNames() []string {
+	themeMut.RLock()
+	defer themeMut.RUnlock()
+	var names []string
+	for name := range themes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// A BaseCP that uses the theme with the given name
+func UseTheme(basecp BaseCP, name string) (BaseCP, error) {
+	t, err := GetTheme(name)
+	if err != nil {
+		return nil, err
+	}
+	return func(state pinterface.IUserState) *ContentPage {
+		cp := basecp(state)
+		t.Apply(cp)
+		return cp
+	}, nil
+}
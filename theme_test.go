@@ -0,0 +1,165 @@
+package genericsite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xyproto/pinterface"
+)
+
+func TestValidCSSColor(t *testing.T) {
+	for _, color := range []string{"red", "RebeccaPurple", "transparent", "#fff", "#ffff", "#5080D0", "#5080d0ff", "rgb(1, 2, 3)", "rgba(1,2,3,0.5)", "rgb(10% 20% 30% / 50%)", "hsl(120deg, 50%, 50%)", "hsl(.5turn, 50%, 50%)", "hsl(100grad 50% 50%)", "hsl(1.5rad, 50%, 50%)", "rgb(1e2, -0, +3.5)"} {
+		if !ValidCSSColor(color) {
+			t.Error("expected a valid color: " + color)
+		}
+	}
+	for _, color := range []string{"", "reddish", "#ff", "#ggg", "#12345", "rgb(1, 2)", "rgb(a, b, c)", "red; background: url(x)", "hsl(1, 2, 3", "rgb(nan, 2, 3)", "rgb(inf, 2, 3)", "rgb(-infinity, 2, 3)", "rgb(0x1p-2, 2, 3)", "rgb(1_0, 2, 3)", "hsl(1degdeg, 50%, 50%)", "rgb(1%%, 2, 3)", "rgb(1., 2, 3)", "hsl(50%, 10%, 10%)", "hsla(10grad%, 10%, 10%, 1)"} {
+		if ValidCSSColor(color) {
+			t.Error("expected an invalid color: " + color)
+		}
+	}
+}
+
+func TestThemeJSON(t *testing.T) {
+	theme, err := ParseThemeJSON([]byte(`{
+	"name": "ocean",
+	"rounded": true,
+	"google_fonts": ["Armata", "Open Sans, bold"],
+	"footer_color": "#003040",
+	"colors": {"nicecolor": "#20a0c0"}
+}`), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if theme.Name != "ocean" || !theme.RoundedLook || theme.FooterColor != "#003040" {
+		t.Errorf("unexpected theme: %+v", theme)
+	}
+	if len(theme.GoogleFonts) != 2 || theme.GoogleFonts[1] != "Open Sans, bold" {
+		t.Errorf("unexpected fonts: %q", theme.GoogleFonts)
+	}
+	if theme.ColorScheme.Nicecolor != "#20a0c0" {
+		t.Error("expected the color from the file")
+	}
+	if theme.ColorScheme.Darkgray != DefaultTheme().ColorScheme.Darkgray {
+		t.Error("colors that are not given should be taken from the default theme")
+	}
+
+	if _, err := ParseThemeJSON([]byte(`{"colors": {"menu_link": "blurple"}}`), "bad"); err == nil || !strings.Contains(err.Error(), "menu_link") {
+		t.Errorf("expected the invalid color to be reported, got %v", err)
+	}
+	if _, err := ParseThemeJSON([]byte(`{"rounded": yes}`), "bad"); err == nil || !strings.Contains(err.Error(), "bad") {
+		t.Errorf("expected the theme to be reported, got %v", err)
+	}
+}
+
+func TestThemeTOML(t *testing.T) {
+	theme, err := ParseThemeTOML([]byte(`
+# A theme
+name = "ocean" # the name
+rounded = true
+google_fonts = ["Armata", "Open Sans, bold"]
+footer_color = '#003040'
+footer_text_color = "rgb(200,\u0020220, 240)"
+sans_serif = 'C:\Fonts\Sans'
+
+[colors]
+nicecolor = "#20a0c0" # a nice color
+
+[colors.dark]
+content_background = "#101820"
+`), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if theme.Name != "ocean" || !theme.RoundedLook || theme.FooterColor != "#003040" {
+		t.Errorf("unexpected theme: %+v", theme)
+	}
+	// Escapes in basic strings, but not in literal strings
+	if theme.FooterTextColor != "rgb(200, 220, 240)" || theme.CustomSansSerif != "C:\\Fonts\\Sans" {
+		t.Errorf("unexpected strings: %q %q", theme.FooterTextColor, theme.CustomSansSerif)
+	}
+	if len(theme.GoogleFonts) != 2 || theme.GoogleFonts[1] != "Open Sans, bold" {
+		t.Errorf("unexpected fonts: %q", theme.GoogleFonts)
+	}
+	if theme.ColorScheme.Nicecolor != "#20a0c0" || theme.ColorScheme.Dark == nil || theme.ColorScheme.Dark.Content_background != "#101820" {
+		t.Errorf("expected the colors from the tables: %+v", theme.ColorScheme)
+	}
+	if theme.ColorScheme.Darkgray != DefaultTheme().ColorScheme.Darkgray {
+		t.Error("colors that are not given should be taken from the default theme")
+	}
+
+	if _, err := ParseThemeTOML([]byte("[colors]\nmenu_link = \"blurple\"\n"), "bad"); err == nil || !strings.Contains(err.Error(), "menu_link") {
+		t.Errorf("expected the invalid color to be reported, got %v", err)
+	}
+	for _, bad := range []string{"rounded = yes\n", "name = \"ocean\"\nname = \"lake\"\n", "name = \"\\x41\"\n"} {
+		if _, err := ParseThemeTOML([]byte(bad), "bad"); err == nil || !strings.Contains(err.Error(), "bad") {
+			t.Errorf("expected an error for %q, got %v", bad, err)
+		}
+	}
+}
+
+func TestThemeDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "themes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "forest.json"), []byte(`{"colors": {"default_background": "darkgreen"}, "footer_text_color": "rgb(200, 220, 200)"}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a theme"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "lake.toml"), []byte("footer_color = \"navy\"\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("name = \"notes\"\n"), 0644)
+
+	if err := LoadThemeDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	found := 0
+	for _, name := range ThemeNames() {
+		if name == "forest" || name == "lake" {
+			found++
+		}
+		if name == "notes" {
+			t.Error("only .json and .toml files should be loaded as themes")
+		}
+	}
+	if found != 2 {
+		t.Fatalf("expected the themes to be named after the files: %q", ThemeNames())
+	}
+	if lake, err := GetTheme("lake"); err != nil || lake.FooterColor != "navy" {
+		t.Error("expected the theme from the TOML file")
+	}
+	if _, err := LoadThemeFile(filepath.Join(dir, "notes.txt")); err == nil {
+		t.Error("expected an error for a theme that is not in JSON or TOML")
+	}
+
+	basecp, err := UseTheme(func(state pinterface.IUserState) *ContentPage { return DefaultCP(state) }, "forest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := basecp(nil)
+	if cp.ColorScheme.Default_background != "darkgreen" || cp.FooterTextColor != "rgb(200, 220, 200)" {
+		t.Errorf("expected the theme to be used: %+v", cp)
+	}
+	cp.ColorScheme.Default_background = "red"
+	if basecp(nil).ColorScheme.Default_background != "darkgreen" {
+		t.Error("pages should not share the colors of the theme")
+	}
+
+	if _, err := UseTheme(basecp, "nonexisting"); err == nil {
+		t.Error("expected an error for a theme that does not exist")
+	}
+}
+
+func TestPresetThemes(t *testing.T) {
+	for _, name := range []string{"default", "light", "dark", "solarized"} {
+		theme, err := GetTheme(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := theme.Validate(); err != nil {
+			t.Error(err)
+		}
+	}
+}
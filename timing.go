@@ -0,0 +1,142 @@
+package genericsite
+
+// Timing of requests, shown in the footer and sent as a Server-Timing header
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xyproto/onthefly"
+)
+
+const (
+	// The footer of generated pages has this placeholder, for the time it took to serve the page
+	generatedInKey = "generatedin"
+
+	// The placeholder is first rendered as this marker, which is replaced when the page is done.
+	// If the marker is left in the page, it is just an HTML comment.
+	generatedInMarker = "<!--generatedin-->"
+)
+
+type (
+	// The timing of one request, see https://www.w3.org/TR/server-timing/
+	// All methods can be called on a nil *RequestTiming, and then do nothing.
+	RequestTiming struct {
+		start   time.Time
+		mut     sync.Mutex
+		metrics []timingMetric
+	}
+
+	timingMetric struct {
+		name     string
+		duration time.Duration
+	}
+
+	timingKeyType struct{}
+)
+
+var timingKey timingKeyType
+
+// Start timing a request from now
+func NewRequestTiming() *RequestTiming {
+	return &RequestTiming{start: time.Now()}
+}
+
+// The timing of the request, or nil if it is not being timed
+func TimingFrom(req *http.Request) *RequestTiming {
+	rt, _ := req.Context().Value(timingKey).(*RequestTiming)
+	return rt
+}
+
+// The timing of the request. If it is not being timed, timing starts now.
+func timingFor(req *http.Request) (*RequestTiming, *http.Request) {
+	if rt := TimingFrom(req); rt != nil {
+		return rt, req
+	}
+	rt := NewRequestTiming()
+	return rt, req.WithContext(context.WithValue(req.Context(), timingKey, rt))
+}
+
+// Start timing as soon as a request arrives, instead of when the page handler is reached
+func TimingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, req = timingFor(req)
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Add the duration of a part of the request. Durations with the same name are added together.
+func (rt *RequestTiming) Add(name string, d time.Duration) {
+	if rt == nil {
+		return
+	}
+	rt.mut.Lock()
+	defer rt.mut.Unlock()
+	for i := range rt.metrics {
+		if rt.metrics[i].name == name {
+			rt.metrics[i].duration += d
+			return
+		}
+	}
+	rt.metrics = append(rt.metrics, timingMetric{name, d})
+}
+
+// Start measuring a part of the request. Call the returned function when it is done.
+func (rt *RequestTiming) Measure(name string) func() {
+	if rt == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		rt.Add(name, time.Since(start))
+	}
+}
+
+// The time since the request started
+func (rt *RequestTiming) Elapsed() time.Duration {
+	if rt == nil {
+		return 0
+	}
+	return time.Since(rt.start)
+}
+
+// Milliseconds, as used by Server-Timing
+func timingMilliseconds(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
+
+// The value of the Server-Timing header, with the total time until now last
+func (rt *RequestTiming) Header() string {
+	if rt == nil {
+		return ""
+	}
+	total := rt.Elapsed()
+	rt.mut.Lock()
+	defer rt.mut.Unlock()
+	var parts []string
+	for _, m := range rt.metrics {
+		parts = append(parts, m.name+";dur="+timingMilliseconds(m.duration))
+	}
+	return strings.Join(append(parts, "total;dur="+timingMilliseconds(total)), ", ")
+}
+
+// A copy of the template values, with the placeholder for the time it took to serve the page
+func withGeneratedIn(values onthefly.TemplateValues) onthefly.TemplateValues {
+	tv := make(onthefly.TemplateValues, len(values)+1)
+	for key, value := range values {
+		tv[key] = value
+	}
+	tv[generatedInKey] = generatedInMarker
+	return tv
+}
+
+// Fill in the time it took to serve the page, and set the Server-Timing header.
+// The time is measured until right before the response is written.
+func (rt *RequestTiming) finish(w http.ResponseWriter, html string) string {
+	w.Header().Set("Server-Timing", rt.Header())
+	return strings.Replace(html, generatedInMarker, rt.Elapsed().String(), -1)
+}
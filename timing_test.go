@@ -0,0 +1,72 @@
+package genericsite
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestGeneratedIn(t *testing.T) {
+	cp := DefaultCP(nil)
+	cp.Url = "/page"
+	r := mux.NewRouter()
+	r.Use(TimingMiddleware)
+	PublishCPs(r, newMemUserState(), PageCollection{*cp}, cp.ColorScheme, testTVGF(), "/css/menu.css")
+	r.HandleFunc("/wrapped", cp.WrapSimpleContextHandle(r, func(w http.ResponseWriter, req *http.Request) string {
+		time.Sleep(2 * time.Millisecond)
+		return "slow"
+	}, testTVGF()(newMemUserState())))
+
+	generatedIn := regexp.MustCompile(`Generated in ([0-9.]+[µnm]?s) \|`)
+	for url, metrics := range map[string][]string{
+		"/page":    {"values;dur=", "menu;dur=", "render;dur=", "total;dur="},
+		"/wrapped": {"content;dur=", "values;dur=", "menu;dur=", "render;dur=", "total;dur="},
+	} {
+		w := get(r, url, nil)
+		body := w.Body.String()
+		if !generatedIn.MatchString(body) || strings.Contains(body, generatedInMarker) {
+			t.Errorf("expected the time it took to serve %s in the footer", url)
+		}
+		header := w.Header().Get("Server-Timing")
+		for _, metric := range metrics {
+			if !strings.Contains(header, metric) {
+				t.Errorf("expected %s in the Server-Timing header for %s: %s", metric, url, header)
+			}
+		}
+		if get(r, url, nil).Header().Get("ETag") != w.Header().Get("ETag") {
+			t.Errorf("the ETag for %s should not depend on the time", url)
+		}
+	}
+
+	elapsed, err := time.ParseDuration(generatedIn.FindStringSubmatch(get(r, "/wrapped", nil).Body.String())[1])
+	if err != nil || elapsed < 2*time.Millisecond {
+		t.Error("the time should cover the whole request")
+	}
+}
+
+func TestNilTiming(t *testing.T) {
+	var rt *RequestTiming
+	rt.Measure("nothing")()
+	if rt.Header() != "" || rt.Elapsed() != 0 {
+		t.Error("a nil timing should do nothing")
+	}
+}
+
+func TestNoGeneratedInWithoutTiming(t *testing.T) {
+	cp := DefaultCP(nil)
+	cp.FooterText = "Made with Go"
+	for _, html := range []string{first(cp.Surround("<p>Hi</p>", map[string]string{})), first(RenderPage(genericPageBuilder(cp), map[string]string{}))} {
+		if strings.Contains(html, "Generated in") || !strings.Contains(html, cp.FooterText) {
+			t.Error("expected the footer without the time it took, when it is not measured")
+		}
+	}
+}
+
+// The first of two strings
+func first(a, _ string) string {
+	return a
+}
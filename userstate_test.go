@@ -0,0 +1,376 @@
+package genericsite
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/xyproto/pinterface"
+)
+
+// In-memory user state, for testing the engines without a database
+
+type memHashMap struct {
+	mut  sync.Mutex
+	data map[string]map[string]string
+}
+
+func newMemHashMap() *memHashMap {
+	return &memHashMap{data: make(map[string]map[string]string)}
+}
+
+func (h *memHashMap) Set(owner, key, value string) error {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if h.data[owner] == nil {
+		h.data[owner] = make(map[string]string)
+	}
+	h.data[owner][key] = value
+	return nil
+}
+
+func (h *memHashMap) Get(owner, key string) (string, error) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	value, ok := h.data[owner][key]
+	if !ok {
+		return "", errors.New("not found")
+	}
+	return value, nil
+}
+
+func (h *memHashMap) Has(owner, key string) (bool, error) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	_, ok := h.data[owner][key]
+	return ok, nil
+}
+
+func (h *memHashMap) Exists(owner string) (bool, error) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	_, ok := h.data[owner]
+	return ok, nil
+}
+
+func (h *memHashMap) All() ([]string, error) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	var owners []string
+	for owner := range h.data {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	return owners, nil
+}
+
+func (h *memHashMap) Keys(owner string) ([]string, error) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	var keys []string
+	for key := range h.data[owner] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (h *memHashMap) DelKey(owner, key string) error {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	delete(h.data[owner], key)
+	return nil
+}
+
+func (h *memHashMap) Del(owner string) error {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	delete(h.data, owner)
+	return nil
+}
+
+func (h *memHashMap) Remove() error {
+	return h.Clear()
+}
+
+func (h *memHashMap) Clear() error {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	h.data = make(map[string]map[string]string)
+	return nil
+}
+
+type memKeyValue struct {
+	mut  sync.Mutex
+	data map[string]string
+}
+
+func (kv *memKeyValue) Set(key, value string) error {
+	kv.mut.Lock()
+	defer kv.mut.Unlock()
+	kv.data[key] = value
+	return nil
+}
+
+func (kv *memKeyValue) Get(key string) (string, error) {
+	kv.mut.Lock()
+	defer kv.mut.Unlock()
+	value, ok := kv.data[key]
+	if !ok {
+		return "", errors.New("no such key: " + key)
+	}
+	return value, nil
+}
+
+func (kv *memKeyValue) Del(key string) error {
+	kv.mut.Lock()
+	defer kv.mut.Unlock()
+	delete(kv.data, key)
+	return nil
+}
+
+func (kv *memKeyValue) Inc(key string) (string, error) {
+	kv.mut.Lock()
+	defer kv.mut.Unlock()
+	n, _ := strconv.Atoi(kv.data[key])
+	kv.data[key] = strconv.Itoa(n + 1)
+	return kv.data[key], nil
+}
+
+func (kv *memKeyValue) Remove() error {
+	return kv.Clear()
+}
+
+func (kv *memKeyValue) Clear() error {
+	kv.mut.Lock()
+	defer kv.mut.Unlock()
+	kv.data = make(map[string]string)
+	return nil
+}
+
+type memCreator struct {
+	mut       sync.Mutex
+	hashMaps  map[string]*memHashMap
+	keyValues map[string]*memKeyValue
+}
+
+func (c *memCreator) NewList(id string) (pinterface.IList, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *memCreator) NewSet(id string) (pinterface.ISet, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *memCreator) NewHashMap(id string) (pinterface.IHashMap, error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.hashMaps == nil {
+		c.hashMaps = make(map[string]*memHashMap)
+	}
+	if c.hashMaps[id] == nil {
+		c.hashMaps[id] = newMemHashMap()
+	}
+	return c.hashMaps[id], nil
+}
+
+func (c *memCreator) NewKeyValue(id string) (pinterface.IKeyValue, error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.keyValues == nil {
+		c.keyValues = make(map[string]*memKeyValue)
+	}
+	if c.keyValues[id] == nil {
+		c.keyValues[id] = &memKeyValue{data: make(map[string]string)}
+	}
+	return c.keyValues[id], nil
+}
+
+// The logged in user is given by the "user" cookie, without any signing
+type memUserState struct {
+	users       *memHashMap
+	unconfirmed map[string]bool
+	creator     *memCreator
+	codeCounter int
+}
+
+func newMemUserState() *memUserState {
+	return &memUserState{users: newMemHashMap(), unconfirmed: make(map[string]bool), creator: &memCreator{}}
+}
+
+func (s *memUserState) UserRights(req *http.Request) bool {
+	username := s.Username(req)
+	return username != "" && s.IsLoggedIn(username)
+}
+
+func (s *memUserState) HasUser(username string) bool {
+	ok, _ := s.users.Has(username, "password")
+	return ok
+}
+
+func (s *memUserState) BooleanField(username, fieldname string) bool {
+	value, _ := s.users.Get(username, fieldname)
+	return value == "true"
+}
+
+func (s *memUserState) SetBooleanField(username, fieldname string, val bool) {
+	s.users.Set(username, fieldname, strconv.FormatBool(val))
+}
+
+func (s *memUserState) IsConfirmed(username string) bool {
+	return s.BooleanField(username, "confirmed")
+}
+func (s *memUserState) IsLoggedIn(username string) bool { return s.BooleanField(username, "loggedin") }
+
+func (s *memUserState) AdminRights(req *http.Request) bool {
+	return s.UserRights(req) && s.IsAdmin(s.Username(req))
+}
+
+func (s *memUserState) IsAdmin(username string) bool { return s.BooleanField(username, "admin") }
+
+func (s *memUserState) UsernameCookie(req *http.Request) (string, error) {
+	c, err := req.Cookie("user")
+	if err != nil {
+		return "", err
+	}
+	return c.Value, nil
+}
+
+func (s *memUserState) SetUsernameCookie(w http.ResponseWriter, username string) error {
+	http.SetCookie(w, &http.Cookie{Name: "user", Value: username, Path: "/"})
+	return nil
+}
+
+func (s *memUserState) AllUsernames() ([]string, error) {
+	var usernames []string
+	owners, _ := s.users.All()
+	for _, owner := range owners {
+		if s.HasUser(owner) {
+			usernames = append(usernames, owner)
+		}
+	}
+	return usernames, nil
+}
+
+func (s *memUserState) Email(username string) (string, error) { return s.users.Get(username, "email") }
+func (s *memUserState) PasswordHash(username string) (string, error) {
+	return s.users.Get(username, "password")
+}
+
+func (s *memUserState) AllUnconfirmedUsernames() ([]string, error) {
+	var usernames []string
+	for username := range s.unconfirmed {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	return usernames, nil
+}
+
+func (s *memUserState) ConfirmationCode(username string) (string, error) {
+	return s.users.Get(username, "confirmationCode")
+}
+
+func (s *memUserState) AddUnconfirmed(username, confirmationCode string) {
+	s.unconfirmed[username] = true
+	s.users.Set(username, "confirmationCode", confirmationCode)
+}
+
+func (s *memUserState) RemoveUnconfirmed(username string) {
+	delete(s.unconfirmed, username)
+	s.users.DelKey(username, "confirmationCode")
+}
+
+func (s *memUserState) MarkConfirmed(username string)  { s.SetBooleanField(username, "confirmed", true) }
+func (s *memUserState) RemoveUser(username string)     { s.users.Del(username) }
+func (s *memUserState) SetAdminStatus(username string) { s.SetBooleanField(username, "admin", true) }
+func (s *memUserState) RemoveAdminStatus(username string) {
+	s.SetBooleanField(username, "admin", false)
+}
+
+func (s *memUserState) AddUser(username, password, email string) {
+	s.users.Set(username, "password", s.HashPassword(username, password))
+	s.users.Set(username, "email", email)
+	for _, fieldname := range []string{"loggedin", "confirmed", "admin"} {
+		s.SetBooleanField(username, fieldname, false)
+	}
+}
+
+func (s *memUserState) SetLoggedIn(username string)  { s.SetBooleanField(username, "loggedin", true) }
+func (s *memUserState) SetLoggedOut(username string) { s.SetBooleanField(username, "loggedin", false) }
+
+func (s *memUserState) Login(w http.ResponseWriter, username string) error {
+	s.SetLoggedIn(username)
+	return s.SetUsernameCookie(w, username)
+}
+
+func (s *memUserState) ClearCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: "user", Value: "", Path: "/", MaxAge: -1})
+}
+
+func (s *memUserState) Logout(username string) { s.SetLoggedOut(username) }
+
+func (s *memUserState) Username(req *http.Request) string {
+	username, _ := s.UsernameCookie(req)
+	return username
+}
+
+func (s *memUserState) CookieTimeout(username string) int64    { return 3600 }
+func (s *memUserState) SetCookieTimeout(cookieTime int64)      {}
+func (s *memUserState) CookieSecret() string                   { return "" }
+func (s *memUserState) SetCookieSecret(cookieSecret string)    {}
+func (s *memUserState) PasswordAlgo() string                   { return "plain" }
+func (s *memUserState) SetPasswordAlgo(algorithm string) error { return nil }
+
+func (s *memUserState) HashPassword(username, password string) string {
+	return "hash:" + password
+}
+
+func (s *memUserState) SetPassword(username, password string) {
+	s.users.Set(username, "password", s.HashPassword(username, password))
+}
+
+func (s *memUserState) CorrectPassword(username, password string) bool {
+	hash, err := s.PasswordHash(username)
+	return err == nil && hash == s.HashPassword(username, password)
+}
+
+func (s *memUserState) AlreadyHasConfirmationCode(confirmationCode string) bool {
+	_, err := s.FindUserByConfirmationCode(confirmationCode)
+	return err == nil
+}
+
+func (s *memUserState) FindUserByConfirmationCode(confirmationCode string) (string, error) {
+	for username := range s.unconfirmed {
+		if code, _ := s.ConfirmationCode(username); code == confirmationCode {
+			return username, nil
+		}
+	}
+	return "", errors.New("the confirmation code is no longer valid")
+}
+
+func (s *memUserState) Confirm(username string) {
+	s.RemoveUnconfirmed(username)
+	s.MarkConfirmed(username)
+}
+
+func (s *memUserState) ConfirmUserByConfirmationCode(confirmationCode string) error {
+	username, err := s.FindUserByConfirmationCode(confirmationCode)
+	if err != nil {
+		return err
+	}
+	s.Confirm(username)
+	return nil
+}
+
+func (s *memUserState) SetMinimumConfirmationCodeLength(length int) {}
+
+func (s *memUserState) GenerateUniqueConfirmationCode() (string, error) {
+	s.codeCounter++
+	return "code" + strconv.Itoa(s.codeCounter), nil
+}
+
+func (s *memUserState) Users() pinterface.IHashMap   { return s.users }
+func (s *memUserState) Host() pinterface.IHost       { return nil }
+func (s *memUserState) Creator() pinterface.ICreator { return s.creator }
@@ -6,16 +6,186 @@ import (
 	"strings"
 	"time"
 
+	"github.com/drbawb/mustache"
 	"github.com/xyproto/onthefly"
 )
 
+// Screens up to this width get the layout for phones, by default
+const mobileMaxWidth = "40em"
+
+const (
+	// Show or hide the menu on narrow screens
+	menuToggleJS = `function toggleMenu(button) {
+  var open = document.getElementById("menubox").classList.toggle("open");
+  button.setAttribute("aria-expanded", open ? "true" : "false");
+}`
+
+	// On narrow screens, the search box is only an icon. The first click shows the search box, instead of searching.
+	searchClickedJS = `function searchClicked(form) {
+  var input = document.getElementById("inputtext");
+  if (input.offsetParent !== null) {
+    return true;
+  }
+  form.classList.add("open");
+  input.focus();
+  return false;
+}`
+)
+
+// Template for the layout for narrow screens, like phones.
+// The header, menu and footer are no longer fixed, and the content box fills the width of the screen.
+const responsive_tmpl = `
+@media (max-width: {{maxwidth}}) {
+body {
+  margin: 0;
+}
+
+#topbox, #titlebox, #menubox, #notice {
+  position: static;
+}
+
+#topbox {
+  padding: 0;
+}
+
+#titlebox {
+  height: auto;
+  width: auto;
+  padding: 0.6em 0.8em;
+  overflow: hidden;
+}
+
+#whitetitle, #bluetitle {
+  font-size: 1.4em;
+}
+
+#graytitle {
+  font-size: 0.9em;
+}
+
+#searchbox {
+  padding: 0;
+}
+
+#innerdiv {
+  display: none;
+}
+
+#search.open #innerdiv {
+  display: inline-block;
+}
+
+#inputtext {
+  width: 9em;
+}
+
+.searchicon {
+  display: inline;
+}
+
+.searchtext {
+  position: absolute;
+  width: 1px;
+  height: 1px;
+  overflow: hidden;
+  clip: rect(0 0 0 0);
+  white-space: nowrap;
+}
+
+#menubox {
+  padding: 0;
+}
+
+#menutoggle {
+  display: block;
+}
+
+#menubox .menuList {
+  display: none;
+  float: none;
+  padding: 0;
+}
+
+#menubox.open .menuList {
+  display: block;
+}
+
+#menubox li {
+  display: block;
+  padding: 0.5em 1em;
+}
+
+#menubox .separator {
+  display: none;
+}
+
+#menubox .submenu {
+  position: static;
+  box-shadow: none;
+  padding-left: 1em;
+}
+
+#content {
+  float: none;
+  position: static;
+  min-width: 0;
+  min-height: 0;
+  margin: 0.5em;
+  padding: 0.5em 1em 1em 1em;
+  text-align: left;
+}
+
+#innernotice {
+  padding: 0 0.5em;
+}
+}
+`
+
+// CSS for the layout for screens up to the given width, like "40em".
+// It should come after the CSS for the page, so that it overrides it.
+func ResponsiveCSS(maxWidth string) string {
+	return mustache.Render(responsive_tmpl, map[string]string{"maxwidth": maxWidth})
+}
+
+// Tell phones not to zoom out to show the page as on a larger screen, so that the layout for narrow screens is used
+func AddViewport(page *onthefly.Page) (*onthefly.Tag, error) {
+	head, err := page.GetTag("head")
+	if err != nil {
+		return nil, err
+	}
+	meta := head.AddNewTag("meta")
+	meta.AddAttrib("name", "viewport")
+	meta.AddAttrib("content", "width=device-width, initial-scale=1")
+	return meta, nil
+}
+
+// Add a link to the main content, that is only shown when it has the focus.
+// Keyboard users can then skip the title and the menu. It should be the first thing in the body.
+func AddSkipLink(page *onthefly.Page) (*onthefly.Tag, error) {
+	body, err := page.GetTag("body")
+	if err != nil {
+		return nil, err
+	}
+	a := body.AddNewTag("a")
+	a.AddAttrib("id", "skiplink")
+	a.AddAttrib("href", "#content")
+	// Moved into view by #skiplink:focus in the menu CSS
+	a.AddStyle("position", "absolute")
+	a.AddStyle("left", "-10000px")
+	a.AddStyle("top", "auto")
+	a.AddStyle("z-index", "10")
+	a.AddContent("Skip to content")
+	return a, nil
+}
+
+// The header of the page, with the title and the search box
 func AddTopBox(page *onthefly.Page, title, subtitle, searchURL, searchButtonText, backgroundTextureURL string, roundedLook bool, cs *ColorScheme, addSearchBox bool) (*onthefly.Tag, error) {
 	body, err := page.GetTag("body")
 	if err != nil {
 		return nil, err
 	}
 
-	div := body.AddNewTag("div")
+	div := body.AddNewTag("header")
 	div.AddAttrib("id", "topbox")
 	div.AddStyle("display", "block")
 	div.AddStyle("width", "100%")
@@ -23,7 +193,7 @@ func AddTopBox(page *onthefly.Page, title, subtitle, searchURL, searchButtonText
 	div.AddStyle("padding", "0 0 1em 0")
 	div.AddStyle("top", "0")
 	div.AddStyle("left", "0")
-	div.AddStyle("background-color", cs.Darkgray)
+	div.AddStyle("background-color", colorVar("darkgray", cs.Darkgray))
 	div.AddStyle("position", "fixed")
 	div.AddStyle("display", "block")
 
@@ -42,6 +212,9 @@ func AddTopBox(page *onthefly.Page, title, subtitle, searchURL, searchButtonText
 	//titlebox.AddStyle("z-index", "2") // 2 is above the search box which is 1
 
 	if addSearchBox {
+		if _, err := page.AddScriptToHead(searchClickedJS); err != nil {
+			return nil, err
+		}
 		searchbox := AddSearchBox(titlebox, searchURL, searchButtonText, roundedLook)
 		searchbox.AddAttrib("id", "searchbox")
 		searchbox.AddStyle("position", "relative")
@@ -58,12 +231,13 @@ func AddTopBox(page *onthefly.Page, title, subtitle, searchURL, searchButtonText
 }
 
 // TODO: Place at the bottom of the content instead of at the bottom of the window
+// If elapsed is 0, the time it took to serve the page is filled in for every request.
 func AddFooter(page *onthefly.Page, footerText, footerTextColor, footerColor string, elapsed time.Duration) (*onthefly.Tag, error) {
 	body, err := page.GetTag("body")
 	if err != nil {
 		return nil, err
 	}
-	div := body.AddNewTag("div")
+	div := body.AddNewTag("footer")
 	div.AddAttrib("id", "notice")
 	div.AddStyle("position", "fixed")
 	div.AddStyle("bottom", "0")
@@ -82,7 +256,12 @@ func AddFooter(page *onthefly.Page, footerText, footerTextColor, footerColor str
 	innerdiv.AddStyle("padding", "0 2em 0 0")
 	innerdiv.AddStyle("margin", "0")
 	innerdiv.AddStyle("color", footerTextColor)
-	innerdiv.AddContent("Generated in " + elapsed.String() + " | " + footerText)
+	// Only mention the time it took when it is known, not when rendering with RenderPage or Surround
+	generatedIn := "{{#" + generatedInKey + "}}Generated in {{{" + generatedInKey + "}}} | {{/" + generatedInKey + "}}"
+	if elapsed > 0 {
+		generatedIn = "Generated in " + elapsed.String() + " | "
+	}
+	innerdiv.AddContent(generatedIn + footerText)
 
 	return div, nil
 }
@@ -93,10 +272,12 @@ func AddContent(page *onthefly.Page, contentTitle, contentHTML string) (*onthefl
 		return nil, err
 	}
 
-	div := body.AddNewTag("div")
+	div := body.AddNewTag("main")
 	div.AddAttrib("id", "content")
+	// Can be focused by the skip link
+	div.AddAttrib("tabindex", "-1")
 	div.AddStyle("z-index", "-1")
-	div.AddStyle("color", "black") // content headline color
+	div.AddStyle("color", colorVar("content_text", defaultContentText)) // content headline color
 	div.AddStyle("min-height", "80%")
 	div.AddStyle("min-width", "60%")
 	div.AddStyle("float", "left")
@@ -108,7 +289,7 @@ func AddContent(page *onthefly.Page, contentTitle, contentHTML string) (*onthefl
 	div.AddStyle("padding-right", "5em")
 	div.AddStyle("padding-top", "1em")
 	div.AddStyle("padding-bottom", "2em")
-	div.AddStyle("background-color", "rgba(255,255,255,0.92)")                                                                               // light gray. Transparency with rgba() doesn't work in IE
+	div.AddStyle("background-color", colorVar("content_background", defaultContentBackground))                                               // light gray. Transparency with rgba() doesn't work in IE
 	div.AddStyle("filter", "progid:DXImageTransform.Microsoft.gradient(GradientType=0,startColorstr='#dcffffff', endColorstr='#dcffffff');") // for transparency in IE
 
 	div.AddStyle("text-align", "justify")
@@ -125,7 +306,7 @@ func AddContent(page *onthefly.Page, contentTitle, contentHTML string) (*onthefl
 	//p.CustomSansSerif("Junge")
 	p.SansSerif()
 	p.AddStyle("font-size", "1.0em")
-	p.AddStyle("color", "black") // content text color
+	p.AddStyle("color", colorVar("content_text", defaultContentText)) // content text color
 	p.AddContent(contentHTML)
 
 	return div, nil
@@ -142,6 +323,7 @@ func AddSearchBox(tag *onthefly.Tag, actionURL, buttonText string, roundedLook b
 
 	form := div.AddNewTag("form")
 	form.AddAttrib("id", "search")
+	form.AddAttrib("role", "search")
 	form.AddAttrib("method", "get")
 	form.AddAttrib("action", actionURL)
 
@@ -151,8 +333,21 @@ func AddSearchBox(tag *onthefly.Tag, actionURL, buttonText string, roundedLook b
 	innerDiv.AddStyle("padding-right", "0.5em")
 	innerDiv.AddStyle("display", "inline-block")
 
+	// The label is for screen readers only
+	label := innerDiv.AddNewTag("label")
+	label.AddAttrib("id", "searchlabel")
+	label.AddAttrib("for", "inputtext")
+	label.AddStyle("position", "absolute")
+	label.AddStyle("width", "1px")
+	label.AddStyle("height", "1px")
+	label.AddStyle("overflow", "hidden")
+	label.AddStyle("clip", "rect(0 0 0 0)")
+	label.AddStyle("white-space", "nowrap")
+	label.AddContent(buttonText)
+
 	inputText := innerDiv.AddNewTag("input")
 	inputText.AddAttrib("id", "inputtext")
+	inputText.AddAttrib("type", "search")
 	inputText.AddAttrib("name", "q")
 	inputText.AddAttrib("size", "40")
 	inputText.AddStyle("padding", "0.25em")
@@ -164,25 +359,35 @@ func AddSearchBox(tag *onthefly.Tag, actionURL, buttonText string, roundedLook b
 		inputText.AddStyle("border", "none")
 	}
 
-	// inputButton := form.AddNewTag("input")
-	// inputButton.AddAttrib("id", "inputbutton")
-	// // The position is in the margin
-	// inputButton.AddStyle("margin", "0.08em 0 0 0.4em")
-	// inputButton.AddStyle("padding", "0.2em 0.6em 0.2em 0.6em")
-	// inputButton.AddStyle("float", "right")
-	// inputButton.AddAttrib("type", "submit")
-	// inputButton.AddAttrib("value", buttonText)
-	// inputButton.SansSerif()
-	// //inputButton.AddStyle("overflow", "hidden")
-	// if roundedLook {
-	// 	inputButton.RoundedBox()
-	// } else {
-	// 	inputButton.AddStyle("border", "none")
-	// }
+	inputButton := form.AddNewTag("button")
+	inputButton.AddAttrib("id", "inputbutton")
+	inputButton.AddAttrib("type", "submit")
+	inputButton.AddStyle("padding", "0.25em 0.6em")
+	inputButton.AddStyle("background-color", "#f0f0f0")
+	inputButton.SansSerif()
+	if roundedLook {
+		inputButton.RoundedBox()
+	} else {
+		inputButton.AddStyle("border", "none")
+	}
+	inputButton.AddAttrib("onclick", "return searchClicked(this.form)")
+
+	// Only the icon is shown on narrow screens, but the text is still read by screen readers
+	icon := inputButton.AddNewTag("span")
+	icon.AddAttrib("class", "searchicon")
+	icon.AddAttrib("aria-hidden", "true")
+	icon.AddStyle("display", "none")
+	// Magnifying glass
+	icon.AddContent("&#128269;")
+
+	text := inputButton.AddNewTag("span")
+	text.AddAttrib("class", "searchtext")
+	text.AddContent(buttonText)
 
 	return div
 }
 
+// The title of the site, as a heading that links to the front page
 func AddTitleBox(tag *onthefly.Tag, title, subtitle string, cs *ColorScheme) *onthefly.Tag {
 
 	div := tag.AddNewTag("div")
@@ -190,6 +395,14 @@ func AddTitleBox(tag *onthefly.Tag, title, subtitle string, cs *ColorScheme) *on
 	div.AddStyle("display", "block")
 	div.AddStyle("position", "fixed")
 
+	// The heading should look like the title did before it was a heading
+	h1 := div.AddNewTag("h1")
+	h1.AddAttrib("id", "sitetitle")
+	h1.AddStyle("display", "inline")
+	h1.AddStyle("margin", "0")
+	h1.AddStyle("font-size", "1em")
+	h1.AddStyle("font-weight", "normal")
+
 	word1 := title
 	word2 := ""
 	if strings.Contains(title, " ") {
@@ -197,25 +410,25 @@ func AddTitleBox(tag *onthefly.Tag, title, subtitle string, cs *ColorScheme) *on
 		word2 = strings.SplitN(title, " ", 2)[1]
 	}
 
-	a := div.AddNewTag("a")
+	a := h1.AddNewTag("a")
 	a.AddAttrib("id", "homelink")
 	a.AddAttrib("href", "/")
 	a.AddStyle("text-decoration", "none")
 
-	font0 := a.AddNewTag("div")
+	font0 := a.AddNewTag("span")
 	font0.AddAttrib("id", "whitetitle")
 	font0.AddAttrib("class", "titletext")
-	font0.AddStyle("color", cs.TitleText)
+	font0.AddStyle("color", colorVar("title_text", cs.TitleText))
 	//font0.CustomSansSerif("Armata")
 	font0.SansSerif()
 	font0.AddStyle("font-size", "2.0em")
 	font0.AddStyle("font-weight", "bolder")
 	font0.AddContent(word1)
 
-	font1 := a.AddNewTag("div")
+	font1 := a.AddNewTag("span")
 	font1.AddAttrib("id", "bluetitle")
 	font1.AddAttrib("class", "titletext")
-	font1.AddStyle("color", cs.Nicecolor)
+	font1.AddStyle("color", colorVar("nicecolor", cs.Nicecolor))
 	//font1.CustomSansSerif("Armata")
 	font1.SansSerif()
 	font1.AddStyle("font-size", "2.0em")
@@ -223,7 +436,7 @@ func AddTitleBox(tag *onthefly.Tag, title, subtitle string, cs *ColorScheme) *on
 	font1.AddStyle("overflow", "hidden")
 	font1.AddContent(word2)
 
-	font2 := a.AddNewTag("div")
+	font2 := a.AddNewTag("span")
 	font2.AddAttrib("id", "graytitle")
 	font2.AddAttrib("class", "titletext")
 	font2.AddStyle("font-size", "0.5em")
@@ -244,8 +457,9 @@ func AddMenuBox(page *onthefly.Page, darkBackgroundTexture string, customSansSer
 		return nil, err
 	}
 
-	div := body.AddNewTag("div")
+	div := body.AddNewTag("nav")
 	div.AddAttrib("id", "menubox")
+	div.AddAttrib("aria-label", "Menu")
 	div.AddStyle("display", "block")
 	div.AddStyle("width", "100%")
 	div.AddStyle("margin", "0")
@@ -253,7 +467,7 @@ func AddMenuBox(page *onthefly.Page, darkBackgroundTexture string, customSansSer
 	div.AddStyle("position", "absolute")
 	div.AddStyle("top", "4.3em")
 	div.AddStyle("left", "0")
-	div.AddStyle("background-color", "#0c0c0c") // dark gray, fallback
+	div.AddStyle("background-color", menuBackground) // dark gray, fallback
 	div.AddStyle("background", "url('"+darkBackgroundTexture+"')")
 	div.AddStyle("position", "fixed")
 	div.AddStyle("box-shadow", "1px 3px 5px rgba(0,0,0, .8)")
@@ -261,6 +475,27 @@ func AddMenuBox(page *onthefly.Page, darkBackgroundTexture string, customSansSer
 		div.AddStyle("font-family", customSansSerif)
 	}
 
+	// Shows and hides the menu on narrow screens, and the submenus
+	if _, err := page.AddScriptToHead(menuToggleJS + "\n" + submenuJS); err != nil {
+		return nil, err
+	}
+	button := div.AddNewTag("button")
+	button.AddAttrib("id", "menutoggle")
+	button.AddAttrib("type", "button")
+	button.AddAttrib("aria-expanded", "false")
+	button.AddAttrib("aria-controls", "menulist")
+	button.AddAttrib("aria-label", "Show the menu")
+	button.AddAttrib("onclick", "toggleMenu(this)")
+	button.AddStyle("display", "none")
+	button.AddStyle("padding", "0.2em 0.6em")
+	button.AddStyle("border", "none")
+	button.AddStyle("background", "transparent")
+	button.AddStyle("color", colorVar("menu_link", "#c0c0c0"))
+	button.AddStyle("font-size", "1.5em")
+	button.AddStyle("cursor", "pointer")
+	// Three lines
+	button.AddContent("&#9776;")
+
 	div.AddLastContent("{{{menu}}}")
 
 	return div, nil
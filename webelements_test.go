@@ -0,0 +1,127 @@
+package genericsite
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// Find the opening tag with the given name and attribute, in any order of attributes
+func findTag(html, name, attr string) string {
+	for _, tag := range regexp.MustCompile(`<`+name+`(\s[^>]*)?>`).FindAllString(html, -1) {
+		if strings.Contains(tag, " "+attr) {
+			return tag
+		}
+	}
+	return ""
+}
+
+func TestAccessibleMarkup(t *testing.T) {
+	cp := testBaseCP(nil)
+	page := genericPageBuilder(cp)
+	html := page.String()
+
+	// Landmarks
+	for _, landmark := range []struct{ name, attr string }{
+		{"header", `id="topbox"`},
+		{"nav", `aria-label="Menu"`},
+		{"main", `id="content"`},
+		{"footer", `id="notice"`},
+		{"form", `role="search"`},
+	} {
+		if findTag(html, landmark.name, landmark.attr) == "" {
+			t.Errorf("expected <%s %s>", landmark.name, landmark.attr)
+		}
+	}
+	if strings.Contains(html, `<div id="content"`) || strings.Contains(html, `<div id="menubox"`) {
+		t.Error("the landmarks should not be divs")
+	}
+
+	// The skip link comes first, and goes to the main content, which can be focused
+	body := html[strings.Index(html, "<body>"):]
+	skip := findTag(body, "a", `href="#content"`)
+	if skip == "" || strings.Index(body, skip) > strings.Index(body, "<header") {
+		t.Error("expected a skip link before the header")
+	}
+	if !strings.Contains(findTag(html, "main", `id="content"`), `tabindex="-1"`) {
+		t.Error("expected the main content to be focusable by the skip link")
+	}
+
+	// There is one h1, with the title of the site
+	if n := strings.Count(html, "<h1"); n != 1 {
+		t.Fatalf("expected one h1, got %d", n)
+	}
+	h1 := html[strings.Index(html, "<h1"):strings.Index(html, "</h1>")]
+	if !strings.Contains(h1, "Test") || !strings.Contains(h1, "Site") || strings.Contains(h1, "<div") {
+		t.Error("expected the title in the h1, without block elements: " + h1)
+	}
+
+	// The search input has a label and a submit button
+	if findTag(html, "label", `for="inputtext"`) == "" || findTag(html, "input", `id="inputtext"`) == "" {
+		t.Error("expected a label for the search input")
+	}
+	if findTag(findTag(html, "form", `role="search"`)+html[strings.Index(html, `role="search"`):], "button", `type="submit"`) == "" {
+		t.Error("expected a submit button for the search")
+	}
+
+	if findTag(html, "html", `lang="en"`) == "" {
+		t.Error("expected the language of the page")
+	}
+
+	// Focus styles and the skip link are in the menu CSS
+	css := MenuCSS(false, cp.ColorScheme)
+	if !strings.Contains(css, ":focus-visible") || !strings.Contains(css, "#skiplink:focus") {
+		t.Error("expected focus styles: " + css)
+	}
+
+	// The separators in the menu are not read
+	menu := MenuSnippet(Links2menuEntries([]string{"A:/a", "B:/b"})).String()
+	if findTag(menu, "div", `aria-hidden="true"`) == "" {
+		t.Error("expected the menu separators to be hidden from screen readers: " + menu)
+	}
+}
+
+func TestResponsiveLayout(t *testing.T) {
+	cp := testBaseCP(nil)
+	page := genericPageBuilder(cp)
+	html := page.String()
+
+	if findTag(html, "meta", `name="viewport"`) == "" {
+		t.Error("expected a viewport for phones")
+	}
+	toggle := findTag(html, "button", `id="menutoggle"`)
+	if !strings.Contains(toggle, `aria-controls="menulist"`) || !strings.Contains(toggle, `aria-expanded="false"`) {
+		t.Error("expected a button that shows and hides the menu: " + toggle)
+	}
+	if !strings.Contains(MenuSnippet(Links2menuEntries([]string{"A:/a"})).String(), `id="menulist"`) {
+		t.Error("expected the menu list to be controlled by the toggle")
+	}
+	if findTag(html, "span", `class="searchicon"`) == "" || findTag(html, "span", `class="searchtext"`) == "" {
+		t.Error("expected a search button that can be shown as an icon")
+	}
+
+	// The layout for phones comes last, and the toggle and icon are only shown there
+	css := cp.pageCSS(page)
+	media := strings.Index(css, "@media (max-width: 40em)")
+	if media == -1 || strings.Index(css, "#content {") > media {
+		t.Fatal("expected the layout for phones after the layout for larger screens:\n" + css)
+	}
+	for _, selector := range []string{"#menutoggle {", ".searchicon {"} {
+		i := strings.Index(css, selector)
+		if i == -1 || i > media || !strings.Contains(css[i:i+strings.Index(css[i:], "}")], "display: none;") {
+			t.Errorf("expected %q to be hidden on larger screens", selector)
+		}
+	}
+	for _, s := range []string{"#menubox.open .menuList", "#search.open #innerdiv", "position: static;"} {
+		if !strings.Contains(css[media:], s) {
+			t.Errorf("expected %q for phones", s)
+		}
+	}
+
+	// It can be turned off
+	cp.MobileMaxWidth = ""
+	page = genericPageBuilder(cp)
+	if strings.Contains(cp.pageCSS(page), "@media") || findTag(page.String(), "meta", `name="viewport"`) != "" {
+		t.Error("expected no layout for phones when MobileMaxWidth is empty")
+	}
+}